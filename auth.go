@@ -1,16 +1,44 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const alphanum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
-var registeredTokens = map[string]bool{}
-var activeSessionTokens = map[string]string{}
+// Tokens from /register that haven't been used to log in yet are kept in the
+// registration table until they expire. Like sessions, they are keyed by a
+// hash of the token.
+type Registration struct {
+	Created int64 `json:"created"`
+	// Id of the invite the token was issued for, if any
+	Invite string `json:"invite,omitempty"`
+}
+
+// hashToken returns the key that a secret token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashLoginToken returns the key in token_to_user_id that a login token is
+// stored under. Unlike sessions, login tokens never expire, so the hash is
+// keyed with LOGIN_TOKEN_PEPPER to keep a copy of the data from being enough
+// to check guesses.
+func hashLoginToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(LoginTokenPepper))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
 func randomString(length int) string {
 	bytes := make([]byte, length)
@@ -22,11 +50,7 @@ func randomString(length int) string {
 }
 
 func randomUsername() string {
-	username := "user" + randomString(20)
-	if _, ok := dbRead("token", username); ok {
-		return randomUsername()
-	}
-	return username
+	return "user" + randomString(20)
 }
 
 func randomUserId() string {
@@ -37,48 +61,181 @@ func randomSessionToken() string {
 	return randomString(48)
 }
 
-func register() string {
+func (r Registration) expired(now time.Time) bool {
+	return RegistrationTTL > 0 && now.Sub(time.UnixMilli(r.Created)) > RegistrationTTL
+}
+
+// registrationStore holds the tokens in the registration table. It is safe
+// for concurrent use.
+type registrationStore struct {
+	table string
+
+	// Held while a token is used or swept, so it can only be used once
+	mu sync.Mutex
+	// Number of pending tokens, kept so that Issue doesn't have to count
+	// the table
+	count atomic.Int64
+}
+
+var registrations = &registrationStore{table: "registration"}
+
+func (s *registrationStore) Init() {
+	keys, _ := dbKeys(s.table)
+	s.count.Store(int64(len(keys)))
+}
+
+// Issue creates a new registration token for an invite, which may be empty. It
+// fails if there are already RegistrationMaxPending tokens waiting to be used.
+func (s *registrationStore) Issue(invite string) (string, bool) {
+	if RegistrationMaxPending > 0 && s.count.Add(1) > RegistrationMaxPending {
+		s.count.Add(-1)
+		return "", false
+	}
 	token := randomString(96)
-	registeredTokens[token] = true
-	return token
+	text, _ := json.Marshal(Registration{Created: time.Now().UnixMilli(), Invite: invite})
+	if !dbCreate(s.table, hashToken(token), text) {
+		s.count.Add(-1)
+		return "", false
+	}
+	return token, true
 }
 
-func newActiveSessionToken(token string) string {
-	sessionToken := randomSessionToken()
-	if _, ok := activeSessionTokens[sessionToken]; ok {
-		return newActiveSessionToken(token)
+// Use deletes a registration token and returns it if it was valid.
+func (s *registrationStore) Use(token string) (Registration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registration := Registration{}
+	key := hashToken(token)
+	text, ok := dbRead(s.table, key)
+	if !ok {
+		return registration, false
+	}
+	dbDelete(s.table, key)
+	s.count.Add(-1)
+	if json.Unmarshal(text, &registration) != nil {
+		return registration, false
 	}
-	activeSessionTokens[sessionToken] = token
-	return sessionToken
+	if registration.expired(time.Now()) {
+		s.release(registration)
+		return registration, false
+	}
+	return registration, true
 }
 
-func login(token string) (sessionToken string, ok bool) {
-	if _, ok := registeredTokens[token]; ok {
-		delete(registeredTokens, token)
-		userId := randomUserId()
-		username := randomUsername()
-		user := User{
-			Username: username,
-			Presence: 1,
-			Status:   "New to Harmon!",
+// release gives back the use of an invite that a token that was never used
+// to log in took.
+func (s *registrationStore) release(registration Registration) {
+	if registration.Invite != "" {
+		invites.Release(registration.Invite)
+	}
+}
+
+// Pending returns the number of tokens waiting to be used.
+func (s *registrationStore) Pending() int64 {
+	return s.count.Load()
+}
+
+// Sweep deletes every expired registration token and gives back the invite
+// uses they took.
+func (s *registrationStore) Sweep() {
+	values, _ := dbReadAll(s.table)
+	now := time.Now()
+	removed := 0
+	for key, text := range values {
+		registration := Registration{}
+		if json.Unmarshal(text, &registration) == nil && !registration.expired(now) {
+			continue
+		}
+		s.mu.Lock()
+		if dbExists(s.table, key) {
+			dbDelete(s.table, key)
+			s.count.Add(-1)
+			s.release(registration)
+			removed++
 		}
-		userText, _ := json.Marshal(user)
-		dbWrite("token_to_user_id", token, []byte(userId))
-		dbWrite("username_to_user_id", username, []byte(userId))
-		dbWrite("user", userId, userText)
-		return newActiveSessionToken(token), true
+		s.mu.Unlock()
+	}
+	if removed > 0 {
+		myslog.Info("registrations expired", "removed", removed, "remaining", s.Pending())
 	}
+}
 
-	if _, ok := dbRead("token_to_user_id", token); ok {
-		return newActiveSessionToken(token), true
+// authSweep deletes expired sessions and registration tokens, and disconnects
+// the clients of the expired sessions, which may be idle and wouldn't check
+// their session again.
+func authSweep(hub *Hub) {
+	for _, id := range sessions.Sweep() {
+		hub.revoke <- id
 	}
+	registrations.Sweep()
+}
 
-	return "", false
+func authSweepLoop(hub *Hub, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		authSweep(hub)
+	}
 }
 
-func getToken(sessionToken string) string {
-	if token, ok := activeSessionTokens[sessionToken]; ok {
-		return token
+// createUser creates a new user with a random username.
+func createUser() (userId string, ok bool) {
+	userId = randomUserId()
+	username := ""
+	for i := 0; i < 10 && username == ""; i++ {
+		username = randomUsername()
+		if !dbCreate("username_to_user_id", username, []byte(userId)) {
+			username = ""
+		}
+	}
+	if username == "" {
+		return "", false
+	}
+	user := User{
+		Username: username,
+		Presence: 1,
+		Status:   "New to Harmon!",
 	}
-	return ""
+	userText, _ := json.Marshal(user)
+	return userId, dbWrite("user", userId, userText)
+}
+
+// login returns the user a login token belongs to. A token from /register
+// creates a new user.
+func login(token string) (userId string, ok bool) {
+	if registration, ok := registrations.Use(token); ok {
+		if userId, ok = createUser(); !ok {
+			registrations.release(registration)
+			return "", false
+		}
+		if registration.Invite != "" {
+			invites.Attribute(registration.Invite, userId)
+			myslog.Info("invite used", "id", registration.Invite, "userId", userId)
+		}
+		return userId, dbWrite("token_to_user_id", hashLoginToken(token), []byte(userId))
+	}
+
+	key := hashLoginToken(token)
+	value, ok := dbRead("token_to_user_id", key)
+	if !ok && len(token) != len(key) && dbValidKey(token) {
+		// Tokens used to be stored as they are. Move them to their hash the
+		// first time they are used. A token the length of a hash could be a
+		// key copied from the table, so it is never looked up as it is.
+		if value, ok = dbRead("token_to_user_id", token); ok {
+			if dbCreate("token_to_user_id", key, value) || dbExists("token_to_user_id", key) {
+				dbDelete("token_to_user_id", token)
+				myslog.Info("login token migrated", "userId", string(value))
+			}
+		}
+	}
+	return string(value), ok
+}
+
+// getUserId returns the id of the user a session token belongs to.
+func getUserId(sessionToken string) (string, bool) {
+	session, ok := sessions.Get(sessionToken)
+	return session.UserId, ok
+}
+
+func isDeveloper(userId string) bool {
+	return developers != nil && developers[userId] != nil
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginRegistrationToken(t *testing.T) {
+	testDbInit(t, "memory")
+	token, ok := registrations.Issue("")
+	if !ok {
+		t.Fatal("Issue failed")
+	}
+	userId, ok := login(token)
+	if !ok || !dbExists("user", userId) {
+		t.Fatalf("login = %q, %v, want a new user", userId, ok)
+	}
+	if value, _ := dbRead("token_to_user_id", hashLoginToken(token)); string(value) != userId {
+		t.Errorf("token is stored as %q, want its hash", value)
+	}
+	if got, ok := login(token); !ok || got != userId {
+		t.Errorf("second login = %q, %v, want %q, true", got, ok, userId)
+	}
+}
+
+// TestLoginMigratesRawToken logs in with a token stored as it is, like tokens
+// were before they were hashed.
+func TestLoginMigratesRawToken(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+			token := randomString(96)
+			dbWrite("token_to_user_id", token, []byte("user"))
+
+			if userId, ok := login(token); !ok || userId != "user" {
+				t.Fatalf("login = %q, %v, want user, true", userId, ok)
+			}
+			if dbExists("token_to_user_id", token) {
+				t.Error("raw token is still stored")
+			}
+			if value, _ := dbRead("token_to_user_id", hashLoginToken(token)); string(value) != "user" {
+				t.Errorf("token is stored under its hash as %q, want user", value)
+			}
+			if userId, ok := login(token); !ok || userId != "user" {
+				t.Errorf("login after migration = %q, %v", userId, ok)
+			}
+		})
+	}
+}
+
+// TestLoginRejectsHashLengthToken checks that keys copied out of
+// token_to_user_id can't be used as tokens.
+func TestLoginRejectsHashLengthToken(t *testing.T) {
+	testDbInit(t, "memory")
+	token := randomString(96)
+	key := hashLoginToken(token)
+	dbWrite("token_to_user_id", key, []byte("user"))
+	if userId, ok := login(key); ok {
+		t.Errorf("login with a stored key = %q, true", userId)
+	}
+
+	// Not even a raw token of that length, which can't be told apart
+	raw := strings.Repeat("a", len(key))
+	dbWrite("token_to_user_id", raw, []byte("user"))
+	if userId, ok := login(raw); ok {
+		t.Errorf("login with a raw token the length of a hash = %q, true", userId)
+	}
+	if !dbExists("token_to_user_id", raw) {
+		t.Error("raw token the length of a hash was migrated")
+	}
+	if w := testLogin(t, LoginRequestBody{Token: key}); w.Code == http.StatusOK {
+		t.Error("/login accepted a stored key")
+	}
+}
+
+// testRegistrationAge makes a registration token older.
+func testRegistrationAge(t *testing.T, token string, age time.Duration) {
+	t.Helper()
+	ok := dbUpdate("registration", hashToken(token), func(text []byte, ok bool) ([]byte, bool) {
+		registration := Registration{}
+		if !ok || json.Unmarshal(text, &registration) != nil {
+			return nil, false
+		}
+		registration.Created -= age.Milliseconds()
+		text, _ = json.Marshal(registration)
+		return text, true
+	})
+	if !ok {
+		t.Fatal("registration not found")
+	}
+}
+
+// testRegistrationCount checks that the count of pending tokens matches the
+// table.
+func testRegistrationCount(t *testing.T, want int64) {
+	t.Helper()
+	keys, _ := dbKeys("registration")
+	if pending := registrations.Pending(); pending != want || int64(len(keys)) != want {
+		t.Errorf("Pending = %d with %d tokens, want %d", pending, len(keys), want)
+	}
+}
+
+func TestRegistrationExpiry(t *testing.T) {
+	defer func(ttl time.Duration) { RegistrationTTL = ttl }(RegistrationTTL)
+	RegistrationTTL = time.Hour
+	testDbInit(t, "memory")
+	_, code, id, _ := invites.Create("", 1, 0)
+	invite, ok := invites.Use(code)
+	if !ok {
+		t.Fatal("invites.Use failed")
+	}
+	token, _ := registrations.Issue(invite)
+	fresh, _ := registrations.Issue("")
+
+	testRegistrationAge(t, token, 2*time.Hour)
+	if _, ok := login(token); ok {
+		t.Error("expired token logged in")
+	}
+	if uses := testInviteUses(t, id); uses != 0 {
+		t.Errorf("invite has %d uses after its token expired, want 0", uses)
+	}
+	testRegistrationCount(t, 1)
+
+	testRegistrationAge(t, fresh, 59*time.Minute)
+	if _, ok := login(fresh); !ok {
+		t.Error("token that hasn't expired yet didn't log in")
+	}
+	testRegistrationCount(t, 0)
+}
+
+func TestRegistrationMaxPending(t *testing.T) {
+	defer func(max int64) { RegistrationMaxPending = max }(RegistrationMaxPending)
+	RegistrationMaxPending = 2
+	testDbInit(t, "memory")
+	register := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveHome(nil, w, httptest.NewRequest(http.MethodGet, "/register"+query, nil))
+		return w
+	}
+
+	tokens := []string{}
+	for i := 0; i < 2; i++ {
+		w := register("")
+		body := struct{ Token string }{}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+			t.Fatalf("/register %d = %d %q", i, w.Code, w.Body)
+		}
+		tokens = append(tokens, body.Token)
+	}
+	if w := register(""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/register over the limit = %d, want 503", w.Code)
+	}
+	// The invite isn't used up by a refused registration
+	_, code, id, _ := invites.Create("", 1, 0)
+	if w := register("?invite=" + code); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/register with an invite over the limit = %d, want 503", w.Code)
+	}
+	if uses := testInviteUses(t, id); uses != 0 {
+		t.Errorf("invite has %d uses after a refused registration, want 0", uses)
+	}
+	testRegistrationCount(t, 2)
+
+	// Using a token makes room for another
+	if _, ok := login(tokens[0]); !ok {
+		t.Fatal("login failed")
+	}
+	if w := register("?invite=" + code); w.Code != http.StatusOK {
+		t.Errorf("/register after a token was used = %d, want 200", w.Code)
+	}
+	testRegistrationCount(t, 2)
+}
+
+// TestRegistrationCount uses, expires and sweeps tokens at the same time and
+// checks that the count of pending tokens stays right.
+func TestRegistrationCount(t *testing.T) {
+	defer func(ttl time.Duration) { RegistrationTTL = ttl }(RegistrationTTL)
+	RegistrationTTL = time.Hour
+	testDbInit(t, "memory")
+	tokens := []string{}
+	for i := 0; i < 60; i++ {
+		token, ok := registrations.Issue("")
+		if !ok {
+			t.Fatal("Issue failed")
+		}
+		if i%3 == 0 {
+			testRegistrationAge(t, token, 2*time.Hour)
+		}
+		tokens = append(tokens, token)
+	}
+	testRegistrationCount(t, 60)
+
+	// Two goroutines use the same tokens, expired or not, while two others
+	// sweep the table. Every third token is left alone.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i, token := range tokens {
+				if w < 2 && i%3 != 2 {
+					registrations.Use(token)
+				} else if w >= 2 && i%10 == 0 {
+					registrations.Sweep()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	testRegistrationCount(t, 20)
+
+	// Reloading the count from the table agrees
+	registrations.Init()
+	testRegistrationCount(t, 20)
+	for i := 2; i < len(tokens); i += 3 {
+		testRegistrationAge(t, tokens[i], 2*time.Hour)
+	}
+	registrations.Sweep()
+	testRegistrationCount(t, 0)
+}
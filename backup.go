@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dbBackup writes a consistent backup of every table to w. Writes are blocked
+// while the tables are read, so the backup never holds a partial write. Images
+// are only ever added, never changed, so they are read once writes are let
+// through again and uploads don't wait for them to be copied.
+func dbBackup(w io.Writer) error {
+	tables := []string{}
+	for _, table := range dbTables {
+		if table != "image" {
+			tables = append(tables, table)
+		}
+	}
+	a := newDbArchive(w)
+	dbWriteLock.Lock()
+	err := a.writeTables(dbRaw, tables)
+	dbWriteLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := a.writeTables(dbRaw, []string{"image"}); err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// dbExport writes every table of store to w as a gzipped tar archive with one
+// entry per key, named <table>/<key>. Values are written as stored, so values
+// that are encrypted stay encrypted.
+func dbExport(store Store, w io.Writer) error {
+	a := newDbArchive(w)
+	if err := a.writeTables(store, dbTables); err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// dbArchive is a backup being written, see dbExport.
+type dbArchive struct {
+	gz  *gzip.Writer
+	tw  *tar.Writer
+	now time.Time
+}
+
+func newDbArchive(w io.Writer) *dbArchive {
+	gz := gzip.NewWriter(w)
+	return &dbArchive{gz: gz, tw: tar.NewWriter(gz), now: time.Now()}
+}
+
+func (a *dbArchive) writeTables(store Store, tables []string) error {
+	for _, table := range tables {
+		keys, ok := store.Keys(table)
+		if !ok {
+			continue
+		}
+		for _, key := range keys {
+			value, ok := store.Read(table, key)
+			if !ok {
+				continue
+			}
+			header := &tar.Header{
+				Name:    table + "/" + key,
+				Mode:    0600,
+				Size:    int64(len(value)),
+				ModTime: a.now,
+			}
+			if err := a.tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := a.tw.Write(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *dbArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// dbBackupFile writes a backup of every table to a new file at path.
+func dbBackupFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := dbBackup(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// Tables whose values must be JSON
+var dbJSONTables = []string{"user", "settings", "chat_manifest", "chat_retention", "session", "registration", "invite", "password", "totp"}
+
+// dbImport reads a backup written by dbExport into store, checking every entry
+// as it goes.
+func dbImport(store Store, r io.Reader) (n int, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	keyring, err := cryptLoadKeyring()
+	if err != nil {
+		return 0, err
+	}
+	crypt := newCryptStore(store, keyring)
+	tables := map[string]bool{}
+	for _, table := range dbTables {
+		tables[table] = true
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return n, fmt.Errorf("%s: not a regular file", header.Name)
+		}
+		table, key, _ := strings.Cut(header.Name, "/")
+		if !tables[table] {
+			return n, fmt.Errorf("%s: unknown table %q", header.Name, table)
+		}
+		if !dbValidKey(key) {
+			return n, fmt.Errorf("%s: invalid key", header.Name)
+		}
+		value, err := io.ReadAll(tr)
+		if err != nil {
+			return n, err
+		}
+		// Encrypted values are checked decrypted but imported as they are
+		plain, err := crypt.decrypt(table, key, value)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		if err := dbCheckValue(table, key, plain); err != nil {
+			return n, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		if !store.Write(table, key, value) {
+			return n, fmt.Errorf("%s: write failed", header.Name)
+		}
+		n++
+	}
+	return n, gz.Close()
+}
+
+// dbCheckValue checks that a value is well formed for its table.
+func dbCheckValue(table, key string, value []byte) error {
+	for _, t := range dbJSONTables {
+		if t == table && !json.Valid(value) {
+			return errors.New("invalid JSON")
+		}
+	}
+	if dbIsLogTable(table) {
+		if len(value) > 0 && value[len(value)-1] != '\n' {
+			return errors.New("incomplete last line")
+		}
+		for i, line := range bytes.Split(bytes.TrimSuffix(value, []byte{'\n'}), []byte{'\n'}) {
+			if len(value) > 0 && !json.Valid(line) {
+				return fmt.Errorf("invalid JSON on line %d", i+1)
+			}
+		}
+	}
+	if table == "meta" && key == "version" {
+		version, err := strconv.Atoi(string(value))
+		if err != nil {
+			return errors.New("invalid schema version")
+		}
+		if version > dbLatestVersion() {
+			return fmt.Errorf("schema version %d is newer than this server supports", version)
+		}
+	}
+	return nil
+}
+
+// dbCheckManifests checks that every segment listed in a chat manifest exists.
+func dbCheckManifests(store Store) error {
+	manifests, _ := store.ReadAll("chat_manifest")
+	for chatId, text := range manifests {
+		manifest := chatManifest{}
+		if json.Unmarshal(text, &manifest) != nil {
+			return fmt.Errorf("chat_manifest/%s: invalid manifest", chatId)
+		}
+		for _, segment := range manifest.Segments {
+			table := "chat_messages"
+			if segment.Compressed {
+				table = "chat_archive"
+			}
+			if !segment.Deleted && !store.Exists(table, segment.Key) && !(segment.Size == 0 && !segment.Sealed) {
+				return fmt.Errorf("chat_manifest/%s: missing segment %s/%s", chatId, table, segment.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// dbRestoreFile replaces the data in DATA_DIR with a backup. The backup is
+// checked while it is read into a staging copy next to the live data, which is
+// only swapped in if the whole backup is valid. The replaced data is kept in
+// DATA_DIR. It refuses to run while the server holds the lock on DATA_DIR,
+// and holds it itself so that the server can't start in the middle.
+func dbRestoreFile(path string) error {
+	if DbBackend != "file" && DbBackend != "bolt" {
+		return fmt.Errorf("restore is not supported for DB_BACKEND %q", DbBackend)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := os.MkdirAll(DataDir, dbPerm); err != nil {
+		return err
+	}
+	unlock, err := lockDataDir(DataDir)
+	if errors.Is(err, errDataDirLocked) {
+		return errors.New("the server is running, stop it before restoring")
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	staging := DataDir + "/.restore"
+	os.RemoveAll(staging)
+	defer os.RemoveAll(staging)
+	store, err := openStore(DbBackend, staging)
+	if err != nil {
+		return err
+	}
+	if err := store.Init(dbTables); err != nil {
+		return err
+	}
+	n, err := dbImport(store, file)
+	if err == nil {
+		err = dbCheckManifests(store)
+	}
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+
+	old := fmt.Sprintf("%s/.old-%s", DataDir, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(old, dbPerm); err != nil {
+		return err
+	}
+	names := dbTables
+	if DbBackend == "bolt" {
+		names = []string{"harmon.db"}
+	}
+	if err := dbSwapIn(names, staging, old); err != nil {
+		return err
+	}
+	myslog.Info("restore", "path", path, "records", n, "replacedDataDir", old)
+	return nil
+}
+
+// dbSwapIn moves each of names from DATA_DIR to old and from staging to
+// DATA_DIR. If a move fails, the ones done so far are undone.
+func dbSwapIn(names []string, staging, old string) error {
+	type rename struct{ from, to string }
+	done := []rename{}
+	move := func(from, to string) error {
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		done = append(done, rename{from, to})
+		return nil
+	}
+	for _, name := range names {
+		err := move(DataDir+"/"+name, old+"/"+name)
+		if err == nil || os.IsNotExist(err) {
+			err = move(staging+"/"+name, DataDir+"/"+name)
+		}
+		if err != nil {
+			for i := len(done) - 1; i >= 0; i-- {
+				if err := os.Rename(done[i].to, done[i].from); err != nil {
+					myslog.Error("restore rollback", "from", done[i].to, "to", done[i].from, "err", err)
+				}
+			}
+			os.Remove(old)
+			return err
+		}
+	}
+	return nil
+}
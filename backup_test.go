@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreRefusesWhileRunning(t *testing.T) {
+	for _, backend := range []string{"file", "bolt"} {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+			dbWrite("settings", "a", []byte(`"old"`))
+			path := t.TempDir() + "/backup.tar.gz"
+			if err := dbBackupFile(path); err != nil {
+				t.Fatal(err)
+			}
+			dbWrite("settings", "a", []byte(`"new"`))
+
+			// The store holds the lock on DATA_DIR like the server does
+			if err := dbRestoreFile(path); err == nil || !strings.Contains(err.Error(), "running") {
+				t.Fatalf("restore while running: got %v, want an error", err)
+			}
+			if value, _ := dbRead("settings", "a"); string(value) != `"new"` {
+				t.Errorf("restore while running changed data to %q", value)
+			}
+
+			db.Close()
+			if err := dbRestoreFile(path); err != nil {
+				t.Fatal(err)
+			}
+			dbInit()
+			if value, _ := dbRead("settings", "a"); string(value) != `"old"` {
+				t.Errorf("restored %q, want old", value)
+			}
+		})
+	}
+}
+
+func TestRestoreRollsBack(t *testing.T) {
+	DataDir = t.TempDir()
+	staging, old := DataDir+"/.restore", DataDir+"/.old"
+	for _, dir := range []string{DataDir + "/a", DataDir + "/b", staging + "/a", old} {
+		if err := os.MkdirAll(dir, dbPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(DataDir+"/a/key", []byte("live"), 0600)
+	os.WriteFile(DataDir+"/b/key", []byte("live"), 0600)
+	os.WriteFile(staging+"/a/key", []byte("staged"), 0600)
+
+	// b is missing from staging, so it can't be moved in
+	if err := dbSwapIn([]string{"a", "b"}, staging, old); err == nil {
+		t.Fatal("dbSwapIn succeeded without b in staging")
+	}
+	for path, want := range map[string]string{DataDir + "/a/key": "live", DataDir + "/b/key": "live", staging + "/a/key": "staged"} {
+		if value, err := os.ReadFile(path); err != nil || string(value) != want {
+			t.Errorf("%s has %q, %v, want %q", path, value, err, want)
+		}
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%s wasn't removed", old)
+	}
+}
+
+// imageBlockingStore holds up reads of images until release is closed.
+type imageBlockingStore struct {
+	Store
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *imageBlockingStore) Read(table, key string) ([]byte, bool) {
+	if table == "image" {
+		close(s.reading)
+		<-s.release
+	}
+	return s.Store.Read(table, key)
+}
+
+// TestBackupImagesUnlocked checks that writes go through while images are
+// copied, and that the backup still holds everything.
+func TestBackupImagesUnlocked(t *testing.T) {
+	testDbInit(t, "memory")
+	dbWrite("image", "a.png", []byte("png"))
+	dbWrite("settings", "a", []byte(`{}`))
+	blocking := &imageBlockingStore{Store: dbRaw, reading: make(chan struct{}), release: make(chan struct{})}
+	dbRaw = blocking
+
+	var buf bytes.Buffer
+	done := make(chan error)
+	go func() { done <- dbBackup(&buf) }()
+	<-blocking.reading
+	written := make(chan bool)
+	go func() { written <- dbWrite("settings", "b", []byte(`{}`)) }()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write waited for images to be copied")
+	}
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemStore()
+	store.Init(dbTables)
+	if _, err := dbImport(store, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := store.Read("image", "a.png"); string(value) != "png" {
+		t.Errorf("image = %q in the backup", value)
+	}
+	if !store.Exists("settings", "a") || store.Exists("settings", "b") {
+		t.Error("backup doesn't hold the tables as they were when it started")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Every chat log in chat_messages has a sidecar index in chat_index with one
+// fixed-size record per message. Records are in the same order as the log and
+// hold the message timestamp and the position of its line, which lets
+// clients page through history by message timestamp instead of byte offsets.
+const chatIndexRecordSize = 24
+
+// Maximum number of messages returned by one indexed GetChatMessages request
+const chatMaxLimit = 500
+
+type chatIndexRecord struct {
+	Timestamp int64
+	Offset    int64
+	Length    int64
+}
+
+func (r chatIndexRecord) marshal() []byte {
+	data := make([]byte, 0, chatIndexRecordSize)
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Timestamp))
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Offset))
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Length))
+	return data
+}
+
+func unmarshalChatIndexRecord(data []byte) chatIndexRecord {
+	return chatIndexRecord{
+		Timestamp: int64(binary.BigEndian.Uint64(data[0:8])),
+		Offset:    int64(binary.BigEndian.Uint64(data[8:16])),
+		Length:    int64(binary.BigEndian.Uint64(data[16:24])),
+	}
+}
+
+// Appends to a chat hold its lock so that the log and index stay in step and
+// timestamps stay unique. Readers hold it shared.
+var chatLocks = sync.Map{}
+
+func chatLock(chatId string) *sync.RWMutex {
+	l, _ := chatLocks.LoadOrStore(chatId, &sync.RWMutex{})
+	return l.(*sync.RWMutex)
+}
+
+// chatLastTimestamp caches the newest timestamp of each chat.
+var chatLastTimestamp = sync.Map{}
+
+// chatAppend saves a new chat message to the end of a chat log and indexes it.
+// The log is created if it doesn't exist yet.
+// The message is given a timestamp which is unique and increasing within the
+// chat, so it can be used as the message's id.
+func chatAppend(chatId string, message Message, chatMessage ChatMessage) (Message, bool) {
+	l := chatLock(chatId)
+	l.Lock()
+	defer l.Unlock()
+
+	if !chatExists(chatId) {
+		manifest := chatManifest{Segments: []chatSegment{{Key: chatId, Created: time.Now().UnixMilli()}}}
+		if !chatWriteManifest(chatId, manifest) {
+			return message, false
+		}
+	}
+
+	chatMessage.Timestamp = time.Now().UnixMilli()
+	if last, ok := chatLastTimestamp.Load(chatId); ok && chatMessage.Timestamp <= last.(int64) {
+		chatMessage.Timestamp = last.(int64) + 1
+	}
+	message.Data, _ = json.Marshal(chatMessage)
+	line, err := json.Marshal(message)
+	if err != nil {
+		return message, false
+	}
+
+	log, ok := openChatLog(chatId)
+	if !ok || !chatRotate(log) {
+		return message, false
+	}
+	active := log.active()
+	offset := active.Base + active.Size
+	if !dbAppend("chat_messages", active.Key, append(line, '\n')) {
+		return message, false
+	}
+	record := chatIndexRecord{Timestamp: chatMessage.Timestamp, Offset: offset, Length: int64(len(line))}
+	if !dbAppend("chat_index", chatId, record.marshal()) {
+		myslog.Error("chat index append failed", "chatId", chatId)
+	}
+	chatLastTimestamp.Store(chatId, chatMessage.Timestamp)
+	return message, true
+}
+
+// chatIndexInit checks the index of every chat log and rebuilds the ones that
+// are missing or don't match their log, e.g. logs written before the index
+// existed or truncated by crash recovery.
+func chatIndexInit() {
+	chatIds, _ := dbKeys("chat_manifest")
+	for _, chatId := range chatIds {
+		if !chatIndexValid(chatId) {
+			chatIndexRebuild(chatId)
+		}
+		n := chatIndexCount(chatId)
+		if record, ok := chatIndexRead(chatId, n-1, n); ok && len(record) == 1 {
+			chatLastTimestamp.Store(chatId, record[0].Timestamp)
+		}
+	}
+}
+
+func chatIndexValid(chatId string) bool {
+	log, ok := openChatLog(chatId)
+	if !ok {
+		return false
+	}
+	indexSize, ok := dbSize("chat_index", chatId)
+	if !ok {
+		return log.size() == log.start()
+	}
+	if indexSize%chatIndexRecordSize != 0 {
+		return false
+	}
+	n := int(indexSize / chatIndexRecordSize)
+	if n == 0 {
+		return log.size() == log.start()
+	}
+	records, ok := chatIndexRead(chatId, 0, 1)
+	if !ok || len(records) != 1 || records[0].Offset < log.start() {
+		return false
+	}
+	last, ok := chatIndexRead(chatId, n-1, n)
+	if !ok || len(last) != 1 {
+		return false
+	}
+	// The last indexed line must end exactly at the end of the log
+	return last[0].Offset+last[0].Length+1 == log.size()
+}
+
+func chatIndexRebuild(chatId string) bool {
+	l := chatLock(chatId)
+	l.Lock()
+	defer l.Unlock()
+	return chatIndexRebuildLocked(chatId)
+}
+
+// chatIndexRebuildLocked is chatIndexRebuild for callers that already hold the
+// chat's lock.
+func chatIndexRebuildLocked(chatId string) bool {
+	log, ok := openChatLog(chatId)
+	if !ok {
+		return false
+	}
+	index := []byte{}
+	n := 0
+	for i, segment := range log.manifest.Segments {
+		// A new active segment has nothing stored yet
+		if segment.Deleted || segment.Size == 0 {
+			continue
+		}
+		ok := log.segmentLines(i, func(offset int64, line []byte) {
+			message := Message{}
+			chatMessage := ChatMessage{}
+			if json.Unmarshal(line, &message) == nil && json.Unmarshal(message.Data, &chatMessage) == nil {
+				record := chatIndexRecord{Timestamp: chatMessage.Timestamp, Offset: offset, Length: int64(len(line))}
+				index = append(index, record.marshal()...)
+				n++
+			}
+		})
+		if !ok {
+			return false
+		}
+	}
+	if !dbWrite("chat_index", chatId, index) {
+		myslog.Error("chat index rebuild failed", "chatId", chatId)
+		return false
+	}
+	myslog.Info("chat index rebuilt", "chatId", chatId, "messages", n)
+	return true
+}
+
+// chatIndexTrim drops the index records of messages before start, after the
+// segments holding them have been deleted. The caller must hold the chat's
+// lock.
+func chatIndexTrim(chatId string, start int64) bool {
+	n := chatIndexCount(chatId)
+	records, ok := chatIndexRead(chatId, 0, n)
+	if !ok {
+		return false
+	}
+	index := []byte{}
+	for _, record := range records {
+		if record.Offset >= start {
+			index = append(index, record.marshal()...)
+		}
+	}
+	return dbWrite("chat_index", chatId, index)
+}
+
+func chatIndexCount(chatId string) int {
+	size, _ := dbSize("chat_index", chatId)
+	return int(size / chatIndexRecordSize)
+}
+
+// chatIndexRead reads the index records [i, j) of a chat.
+func chatIndexRead(chatId string, i, j int) ([]chatIndexRecord, bool) {
+	if i < 0 || j <= i {
+		return []chatIndexRecord{}, true
+	}
+	data, ok := dbReadRange("chat_index", chatId, int64(i)*chatIndexRecordSize, (j-i)*chatIndexRecordSize)
+	if !ok {
+		return nil, false
+	}
+	records := make([]chatIndexRecord, 0, j-i)
+	for len(data) >= chatIndexRecordSize {
+		records = append(records, unmarshalChatIndexRecord(data))
+		data = data[chatIndexRecordSize:]
+	}
+	return records, true
+}
+
+// chatIndexSearch returns the position of the first message in a chat with a
+// timestamp of at least timestamp, or n if there is none.
+func chatIndexSearch(chatId string, n int, timestamp int64) int {
+	lo, hi := 0, n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		record, ok := chatIndexRead(chatId, mid, mid+1)
+		if !ok || len(record) != 1 {
+			return n
+		}
+		if record[0].Timestamp < timestamp {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// chatReadMessages reads the indexed messages [i, j) of a chat as lines. The
+// caller must hold the chat's lock.
+func chatReadMessages(chatId string, i, j int) ([][]byte, bool) {
+	records, ok := chatIndexRead(chatId, i, j)
+	if !ok {
+		return nil, false
+	}
+	if len(records) == 0 {
+		return [][]byte{}, true
+	}
+	log, ok := openChatLog(chatId)
+	if !ok {
+		return nil, false
+	}
+	lines := make([][]byte, 0, len(records))
+	for len(records) > 0 {
+		// Read the run of records that are in the same segment at once
+		segment, start, ok := log.translate(records[0].Offset)
+		if !ok {
+			return nil, false
+		}
+		physical := make([]int64, 0, len(records))
+		for _, record := range records {
+			i, p, ok := log.translate(record.Offset)
+			if !ok || i != segment {
+				break
+			}
+			physical = append(physical, p)
+		}
+		n := len(physical)
+		end := physical[n-1] + records[n-1].Length
+		data, ok := log.read(segment, start, int(end-start))
+		if !ok {
+			return nil, false
+		}
+		for k, p := range physical {
+			from, to := p-start, p-start+records[k].Length
+			if to > int64(len(data)) {
+				return nil, false
+			}
+			lines = append(lines, data[from:to])
+		}
+		records = records[n:]
+	}
+	return lines, true
+}
+
+// chatQuery returns up to limit messages of a chat as a JSON array. With
+// before or after set, messages strictly before or after the message with
+// that timestamp are returned, with since set, messages at or after that
+// time, and otherwise the newest messages.
+func chatQuery(chatId string, before, after, since *int64, limit int) (json.RawMessage, bool) {
+	l := chatLock(chatId)
+	l.RLock()
+	defer l.RUnlock()
+
+	if !chatExists(chatId) {
+		return nil, false
+	}
+	if limit > chatMaxLimit {
+		limit = chatMaxLimit
+	}
+	n := chatIndexCount(chatId)
+	i, j := 0, n
+	if before != nil {
+		j = chatIndexSearch(chatId, n, *before)
+		i = max(0, j-limit)
+	} else if after != nil || since != nil {
+		if after != nil {
+			i = chatIndexSearch(chatId, n, *after+1)
+		} else {
+			i = chatIndexSearch(chatId, n, *since)
+		}
+		j = min(n, i+limit)
+	} else {
+		i = max(0, n-limit)
+	}
+
+	lines, ok := chatReadMessages(chatId, i, j)
+	if !ok {
+		return nil, false
+	}
+	return append(append([]byte{'['}, bytes.Join(lines, []byte{','})...), ']'), true
+}
+
+// chatFind returns the message of a chat with the given timestamp.
+func chatFind(chatId string, timestamp int64) (Message, ChatMessage, bool) {
+	l := chatLock(chatId)
+	l.RLock()
+	defer l.RUnlock()
+
+	message := Message{}
+	chatMessage := ChatMessage{}
+	n := chatIndexCount(chatId)
+	i := chatIndexSearch(chatId, n, timestamp)
+	lines, ok := chatReadMessages(chatId, i, min(n, i+1))
+	if !ok || len(lines) != 1 {
+		return message, chatMessage, false
+	}
+	if json.Unmarshal(lines[0], &message) != nil || json.Unmarshal(message.Data, &chatMessage) != nil {
+		return message, chatMessage, false
+	}
+	return message, chatMessage, chatMessage.Timestamp == timestamp
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Compaction rewrites the sealed segments of a chat log so that each message
+// appears once in its latest form. Edit records (messages with
+// EditForTimestamp set) are folded into the message they edit and moved to
+// chat_edits, which keeps the full edit history.
+//
+// A compacted segment keeps the logical range of the segment it replaces and
+// chat_linemap records the logical offset of each of its lines, so byte
+// offsets held by connected clients keep pointing at the same messages.
+// Edits in the active segment are left alone until it is sealed. With
+// CHAT_COMPRESS_SEGMENTS set, compacted segments are compressed again.
+
+// chatLineMapEntry holds the offsets of a line of a compacted segment,
+// relative to the start of the segment.
+type chatLineMapEntry struct {
+	Logical  int64
+	Physical int64
+}
+
+const chatLineMapEntrySize = 16
+
+func marshalLineMap(lineMap []chatLineMapEntry) []byte {
+	data := make([]byte, 0, len(lineMap)*chatLineMapEntrySize)
+	for _, entry := range lineMap {
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.Logical))
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.Physical))
+	}
+	return data
+}
+
+func unmarshalLineMap(data []byte) []chatLineMapEntry {
+	lineMap := make([]chatLineMapEntry, 0, len(data)/chatLineMapEntrySize)
+	for len(data) >= chatLineMapEntrySize {
+		lineMap = append(lineMap, chatLineMapEntry{
+			Logical:  int64(binary.BigEndian.Uint64(data[0:8])),
+			Physical: int64(binary.BigEndian.Uint64(data[8:16])),
+		})
+		data = data[chatLineMapEntrySize:]
+	}
+	return lineMap
+}
+
+func (l *chatLog) lineMap(i int) ([]chatLineMapEntry, bool) {
+	segment := &l.manifest.Segments[i]
+	if !segment.Compacted {
+		return nil, true
+	}
+	if lineMap, ok := l.lineMaps[i]; ok {
+		return lineMap, true
+	}
+	data, ok := dbRead("chat_linemap", segment.Key)
+	if !ok {
+		return nil, false
+	}
+	lineMap := unmarshalLineMap(data)
+	l.lineMaps[i] = lineMap
+	return lineMap, true
+}
+
+// lineMapTranslate converts a logical offset within a compacted segment to a
+// physical one. An offset inside a line maps to the same position in the
+// rewritten line, and an offset inside a record that was folded away maps to
+// the end of the line before it, so that readEntries skips exactly the line
+// the offset falls in.
+func lineMapTranslate(lineMap []chatLineMapEntry, offset int64, physicalSize int64) (int64, bool) {
+	k := sort.Search(len(lineMap), func(k int) bool { return lineMap[k].Logical > offset }) - 1
+	if k < 0 {
+		return 0, true
+	}
+	lineEnd := physicalSize - 1
+	if k+1 < len(lineMap) {
+		lineEnd = lineMap[k+1].Physical - 1
+	}
+	return lineMap[k].Physical + min(offset-lineMap[k].Logical, lineEnd-lineMap[k].Physical), true
+}
+
+type chatCompactLine struct {
+	offset      int64
+	line        []byte
+	message     Message
+	chatMessage ChatMessage
+	parsed      bool
+}
+
+// chatCompact compacts the sealed segments of a chat and returns the number
+// of edits that were folded.
+func chatCompact(chatId string) (folded int, ok bool) {
+	l := chatLock(chatId)
+
+	// Sealed segments never change, so they can be read without holding
+	// the lock
+	l.RLock()
+	log, ok := openChatLog(chatId)
+	l.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	sealed := []int{}
+	lines := map[int][]chatCompactLine{}
+	for i, segment := range log.manifest.Segments {
+		if !segment.Sealed || segment.Deleted {
+			continue
+		}
+		sealed = append(sealed, i)
+		ok := log.segmentLines(i, func(offset int64, line []byte) {
+			c := chatCompactLine{offset: offset - segment.Base, line: line}
+			c.parsed = json.Unmarshal(line, &c.message) == nil && json.Unmarshal(c.message.Data, &c.chatMessage) == nil
+			lines[i] = append(lines[i], c)
+		})
+		if !ok {
+			return 0, false
+		}
+	}
+
+	// Find the latest edit of each message. Edits of edits are followed back
+	// to the message they ultimately edit, also through edits that earlier
+	// compactions moved to chat_edits.
+	editOf := map[int64]int64{}
+	originals := map[int64]bool{}
+	if data, ok := dbRead("chat_edits", chatId); ok {
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			message := Message{}
+			chatMessage := ChatMessage{}
+			if json.Unmarshal(line, &message) == nil && json.Unmarshal(message.Data, &chatMessage) == nil && chatMessage.EditForTimestamp != 0 {
+				editOf[chatMessage.Timestamp] = chatMessage.EditForTimestamp
+			}
+		}
+	}
+	for _, i := range sealed {
+		for _, c := range lines[i] {
+			if !c.parsed {
+				continue
+			}
+			if c.chatMessage.EditForTimestamp != 0 {
+				editOf[c.chatMessage.Timestamp] = c.chatMessage.EditForTimestamp
+			} else {
+				originals[c.chatMessage.Timestamp] = true
+			}
+		}
+	}
+	root := func(timestamp int64) (int64, bool) {
+		for n := 0; n <= len(editOf); n++ {
+			target, ok := editOf[timestamp]
+			if !ok {
+				return timestamp, originals[timestamp]
+			}
+			timestamp = target
+		}
+		return 0, false
+	}
+	latest := map[int64]ChatMessage{}
+	for _, i := range sealed {
+		for _, c := range lines[i] {
+			if !c.parsed || c.chatMessage.EditForTimestamp == 0 {
+				continue
+			}
+			if target, ok := root(c.chatMessage.Timestamp); ok && c.chatMessage.Timestamp > latest[target].Timestamp {
+				latest[target] = c.chatMessage
+			}
+		}
+	}
+	if len(latest) == 0 {
+		return 0, true
+	}
+
+	rewrites := []chatCompactRewrite{}
+	for _, i := range sealed {
+		segment := log.manifest.Segments[i]
+		data := []byte{}
+		lineMap := []chatLineMapEntry{}
+		edits := []byte{}
+		n := 0
+		changed := false
+		for _, c := range lines[i] {
+			line := c.line
+			if c.parsed && c.chatMessage.EditForTimestamp != 0 {
+				if _, ok := root(c.chatMessage.Timestamp); ok {
+					edits = append(append(edits, c.line...), '\n')
+					changed = true
+					n++
+					continue
+				}
+			} else if edit, ok := latest[c.chatMessage.Timestamp]; ok && c.parsed && edit.Timestamp > c.chatMessage.EditedTimestamp {
+				c.chatMessage.Content = edit.Content
+				c.chatMessage.EditedTimestamp = edit.Timestamp
+				c.message.Data, _ = json.Marshal(c.chatMessage)
+				line, _ = json.Marshal(c.message)
+				changed = true
+			}
+			lineMap = append(lineMap, chatLineMapEntry{Logical: c.offset, Physical: int64(len(data))})
+			data = append(append(data, line...), '\n')
+		}
+		if !changed {
+			continue
+		}
+		key := chatSegmentKey(chatId, i, segment.Generation+1)
+		if !dbWrite("chat_linemap", key, marshalLineMap(lineMap)) || !dbWrite("chat_messages", key, data) {
+			return 0, false
+		}
+		rewrites = append(rewrites, chatCompactRewrite{i: i, key: key, size: int64(len(data)), edits: edits, folded: n})
+	}
+
+	// Swap the compacted segments into the manifest
+	l.Lock()
+	folded, swapped, ok := chatCompactSwap(log, rewrites)
+	l.Unlock()
+	if ChatCompressSegments {
+		for _, key := range swapped {
+			chatCompressSegment(chatId, key)
+		}
+	}
+	return folded, ok
+}
+
+// chatCompactRewrite is a compacted segment that has been written but not yet
+// swapped into the manifest.
+type chatCompactRewrite struct {
+	i    int
+	key  string
+	size int64
+	// The edit records folded away
+	edits  []byte
+	folded int
+}
+
+// chatCompactSwap swaps compacted segments into the manifest of the chat that
+// log was opened for, and returns the number of edits folded and the keys of
+// the segments swapped in. The caller must hold the chat's lock.
+//
+// The edits of the segments that are swapped in are saved under the lock
+// since retention rewrites chat_edits, and only once the manifest is written
+// so that a failed swap doesn't leave them in chat_edits to be saved again.
+func chatCompactSwap(log *chatLog, rewrites []chatCompactRewrite) (folded int, swapped []string, ok bool) {
+	chatId := log.chatId
+	manifest, ok := chatReadManifest(chatId)
+	if !ok {
+		return 0, nil, false
+	}
+	old := []chatSegment{}
+	edits := []byte{}
+	for _, r := range rewrites {
+		segment := &manifest.Segments[r.i]
+		if segment.Key != log.manifest.Segments[r.i].Key || segment.Deleted {
+			// The segment changed while we were compacting it
+			dbDelete("chat_messages", r.key)
+			dbDelete("chat_linemap", r.key)
+			continue
+		}
+		old = append(old, *segment)
+		swapped = append(swapped, r.key)
+		segment.Key = r.key
+		segment.Compacted = true
+		segment.Compressed = false
+		segment.PhysicalSize = r.size
+		segment.Generation++
+		edits = append(edits, r.edits...)
+		folded += r.folded
+	}
+	if len(old) == 0 {
+		return 0, nil, true
+	}
+	if !chatWriteManifest(chatId, manifest) {
+		for _, r := range rewrites {
+			dbDelete("chat_messages", r.key)
+			dbDelete("chat_linemap", r.key)
+		}
+		return 0, nil, false
+	}
+	for _, segment := range old {
+		chatDeleteSegmentData(segment)
+	}
+	chatIndexRebuildLocked(chatId)
+	if !dbAppend("chat_edits", chatId, edits) {
+		myslog.Error("chat edits append failed", "chatId", chatId, "folded", folded)
+		return folded, swapped, false
+	}
+	myslog.Info("chat compacted", "chatId", chatId, "segments", len(old), "folded", folded)
+	return folded, swapped, true
+}
+
+// chatCompactAll compacts every chat.
+func chatCompactAll() {
+	chatIds, _ := dbKeys("chat_manifest")
+	for _, chatId := range chatIds {
+		if _, ok := chatCompact(chatId); !ok {
+			myslog.Error("chat compaction failed", "chatId", chatId)
+		}
+	}
+}
+
+// chatCompactLoop compacts every chat every interval.
+func chatCompactLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		chatCompactAll()
+	}
+}
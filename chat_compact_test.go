@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testChatEdits returns the content of every edit in chat_edits.
+func testChatEdits(t *testing.T, chatId string) []string {
+	t.Helper()
+	text, _ := dbRead("chat_edits", chatId)
+	contents := []string{}
+	for _, line := range bytes.Split(bytes.TrimSuffix(text, []byte{'\n'}), []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		message := Message{}
+		chatMessage := ChatMessage{}
+		json.Unmarshal(line, &message)
+		json.Unmarshal(message.Data, &chatMessage)
+		contents = append(contents, chatMessage.Content)
+	}
+	return contents
+}
+
+// TestChatCompactEditChain compacts an edit of an edit whose edit was folded
+// by an earlier compaction.
+func TestChatCompactEditChain(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+			chatId := "global"
+			m1 := testChatAppend(t, chatId, "m1", 0)
+			e1 := testChatAppend(t, chatId, "e1", m1)
+			testChatSeal(t, chatId)
+			if folded, ok := chatCompact(chatId); !ok || folded != 1 {
+				t.Fatalf("first chatCompact = %d, %v, want 1, true", folded, ok)
+			}
+
+			testChatAppend(t, chatId, "e2", e1)
+			testChatAppend(t, chatId, "m2", 0)
+			testChatSeal(t, chatId)
+			if folded, ok := chatCompact(chatId); !ok || folded != 1 {
+				t.Fatalf("second chatCompact = %d, %v, want 1, true", folded, ok)
+			}
+			testChatCheck(t, chatId, []string{"e2", "m2"})
+			if got := testChatEdits(t, chatId); !testEqualStrings(got, []string{"e1", "e2"}) {
+				t.Errorf("chat_edits has %q, want [e1 e2]", got)
+			}
+
+			// Nothing is left to fold, and an older edit doesn't undo a newer
+			// one
+			if folded, ok := chatCompact(chatId); !ok || folded != 0 {
+				t.Errorf("third chatCompact = %d, %v, want 0, true", folded, ok)
+			}
+			testChatCheck(t, chatId, []string{"e2", "m2"})
+		})
+	}
+}
+
+func TestChatCompactCompresses(t *testing.T) {
+	defer func(compress bool) { ChatCompressSegments = compress }(ChatCompressSegments)
+	ChatCompressSegments = true
+	testDbInit(t, "memory")
+	chatId := "global"
+	m1 := testChatAppend(t, chatId, "m1", 0)
+	testChatAppend(t, chatId, "e1", m1)
+	testChatAppend(t, chatId, "m2", 0)
+	testChatSeal(t, chatId)
+	if _, ok := chatCompact(chatId); !ok {
+		t.Fatal("chatCompact failed")
+	}
+	manifest, _ := chatReadManifest(chatId)
+	if segment := manifest.Segments[0]; !segment.Compacted || !segment.Compressed {
+		t.Errorf("compacted segment is %+v, want it compressed", segment)
+	}
+	testChatCheck(t, chatId, []string{"e1", "m2"})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math"
+	"time"
+)
+
+// Retention removes the oldest messages of a chat once they are older than a
+// maximum age or beyond a maximum number of messages. The limits in
+// CHAT_RETENTION_AGE and CHAT_RETENTION_COUNT apply to every chat and can be
+// overridden per chat in chat_retention.
+//
+// Sealed segments that only hold expired messages are deleted. The segment
+// that the oldest kept message is in is rewritten without the expired lines,
+// keeping its logical range like a compacted segment, and the active segment
+// is sealed first if it holds expired messages. Edit records don't count
+// towards the maximum number of messages. Edits of removed messages are
+// removed from chat_edits, and from the log too if they come after the oldest
+// kept message, which rewrites their segments like compaction does.
+
+// chatRetention is a chat's retention rule. Fields that are set override the
+// global limits, and 0 means no limit.
+type chatRetention struct {
+	// Maximum age in milliseconds
+	MaxAge   *int64 `json:"maxAge,omitempty"`
+	MaxCount *int   `json:"maxCount,omitempty"`
+}
+
+// chatRetentionLimits returns the retention limits of a chat.
+func chatRetentionLimits(chatId string) (maxAge time.Duration, maxCount int) {
+	maxAge, maxCount = ChatRetentionAge, int(ChatRetentionCount)
+	rule := chatRetention{}
+	if text, ok := dbRead("chat_retention", chatId); ok && json.Unmarshal(text, &rule) == nil {
+		if rule.MaxAge != nil {
+			maxAge = time.Duration(*rule.MaxAge) * time.Millisecond
+		}
+		if rule.MaxCount != nil {
+			maxCount = *rule.MaxCount
+		}
+	}
+	return maxAge, maxCount
+}
+
+// chatApplyRetention removes the messages of a chat that its retention limits
+// don't allow and returns how many were removed.
+func chatApplyRetention(chatId string) (removed int, ok bool) {
+	maxAge, maxCount := chatRetentionLimits(chatId)
+	if maxAge <= 0 && maxCount <= 0 {
+		return 0, true
+	}
+
+	l := chatLock(chatId)
+	l.Lock()
+	defer l.Unlock()
+
+	// Find the oldest message to keep
+	n := chatIndexCount(chatId)
+	k := 0
+	if maxCount > 0 {
+		count, ok := chatCountCut(chatId, n, maxCount)
+		if !ok {
+			return 0, false
+		}
+		k = max(k, count)
+	}
+	if maxAge > 0 {
+		k = max(k, chatIndexSearch(chatId, n, time.Now().Add(-maxAge).UnixMilli()))
+	}
+	if k == 0 {
+		return 0, true
+	}
+	log, ok := openChatLog(chatId)
+	if !ok {
+		return 0, false
+	}
+	cut := log.size()
+	var oldest int64 = math.MaxInt64
+	if k < n {
+		records, ok := chatIndexRead(chatId, k, k+1)
+		if !ok || len(records) != 1 {
+			return 0, false
+		}
+		cut, oldest = records[0].Offset, records[0].Timestamp
+	}
+	if cut <= log.start() {
+		return 0, true
+	}
+	orphans, ok := chatOrphanEdits(chatId, k, n, oldest)
+	if !ok {
+		return 0, false
+	}
+	inSegment := func(segment chatSegment) bool {
+		for offset := range orphans {
+			if offset >= segment.Base && offset < segment.Base+segment.Size {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only sealed segments can be rewritten or deleted
+	if active := log.active(); active.Size > 0 && (cut > active.Base || inSegment(*active)) {
+		if !chatSeal(log) {
+			return 0, false
+		}
+	}
+
+	// Rewrite the segment that the cut falls in without the expired lines,
+	// and the segments after it without the edits of removed messages
+	trimmed := []string{}
+	for i := range log.manifest.Segments {
+		segment := &log.manifest.Segments[i]
+		if segment.Deleted || !segment.Sealed || segment.Base+segment.Size <= cut {
+			continue
+		}
+		cutHere := cut > segment.Base+segment.Trimmed
+		if !cutHere && !inSegment(*segment) {
+			continue
+		}
+		data := []byte{}
+		lineMap := []chatLineMapEntry{}
+		ok := log.segmentLines(i, func(offset int64, line []byte) {
+			if _, orphan := orphans[offset]; offset >= cut && !orphan {
+				lineMap = append(lineMap, chatLineMapEntry{Logical: offset - segment.Base, Physical: int64(len(data))})
+				data = append(append(data, line...), '\n')
+			}
+		})
+		if !ok {
+			return 0, false
+		}
+		// Keys differ from the ones compaction writes, which it does without
+		// holding the lock
+		key := chatSegmentKey(chatId, i, segment.Generation+1, "t")
+		if !dbWrite("chat_linemap", key, marshalLineMap(lineMap)) || !dbWrite("chat_messages", key, data) {
+			return 0, false
+		}
+		old := *segment
+		segment.Key = key
+		segment.Compacted = true
+		segment.Compressed = false
+		segment.PhysicalSize = int64(len(data))
+		segment.Generation++
+		if cutHere {
+			segment.Trimmed = cut - segment.Base
+		}
+		if !chatWriteManifest(chatId, log.manifest) {
+			dbDelete("chat_messages", key)
+			dbDelete("chat_linemap", key)
+			return 0, false
+		}
+		chatDeleteSegmentData(old)
+		trimmed = append(trimmed, old.Key)
+	}
+
+	deleted, ok := chatDeleteSegments(chatId, func(segment chatSegment) bool {
+		return segment.Base+segment.Size <= cut
+	})
+	if !ok {
+		return 0, false
+	}
+	if len(orphans) > 0 {
+		chatIndexRebuildLocked(chatId)
+	} else if deleted == 0 {
+		chatIndexTrim(chatId, cut)
+	}
+	removedEdits := map[int64]bool{}
+	for _, timestamp := range orphans {
+		removedEdits[timestamp] = true
+	}
+	edits, _ := chatRetainEdits(chatId, oldest, removedEdits)
+
+	args := []any{"chatId", chatId, "messages", k, "orphanEdits", len(orphans), "segmentsDeleted", deleted, "edits", edits}
+	if len(trimmed) > 0 {
+		args = append(args, "segmentsTrimmed", trimmed)
+	}
+	if oldest != math.MaxInt64 {
+		args = append(args, "oldestKept", oldest)
+	}
+	myslog.Info("chat retention", args...)
+	return k + len(orphans), true
+}
+
+// chatCountCut returns the position in the index of the oldest of the newest
+// maxCount messages of a chat, not counting edits, or 0 if there are fewer.
+// The caller must hold the chat's lock.
+func chatCountCut(chatId string, n, maxCount int) (int, bool) {
+	count := 0
+	for j := n; j > 0; j -= chatMaxLimit {
+		i := max(0, j-chatMaxLimit)
+		lines, ok := chatReadMessages(chatId, i, j)
+		if !ok {
+			return 0, false
+		}
+		for k := len(lines) - 1; k >= 0; k-- {
+			message := Message{}
+			chatMessage := ChatMessage{}
+			if json.Unmarshal(lines[k], &message) == nil && json.Unmarshal(message.Data, &chatMessage) == nil && chatMessage.EditForTimestamp != 0 {
+				continue
+			}
+			if count++; count == maxCount {
+				return i + k, true
+			}
+		}
+	}
+	return 0, true
+}
+
+// chatOrphanEdits finds the edits among the indexed messages [k, n) of a chat
+// whose message is older than oldest, directly or through the edits it edits,
+// and returns their logical offsets and timestamps. The caller must hold the
+// chat's lock.
+func chatOrphanEdits(chatId string, k, n int, oldest int64) (orphans map[int64]int64, ok bool) {
+	orphans = map[int64]int64{}
+	orphaned := map[int64]bool{}
+	for i := k; i < n; i += chatMaxLimit {
+		j := min(n, i+chatMaxLimit)
+		records, ok := chatIndexRead(chatId, i, j)
+		if !ok {
+			return nil, false
+		}
+		lines, ok := chatReadMessages(chatId, i, j)
+		if !ok || len(lines) != len(records) {
+			return nil, false
+		}
+		for m, line := range lines {
+			message := Message{}
+			chatMessage := ChatMessage{}
+			if json.Unmarshal(line, &message) != nil || json.Unmarshal(message.Data, &chatMessage) != nil {
+				continue
+			}
+			target := chatMessage.EditForTimestamp
+			if target != 0 && (target < oldest || orphaned[target]) {
+				orphaned[chatMessage.Timestamp] = true
+				orphans[records[m].Offset] = chatMessage.Timestamp
+			}
+		}
+	}
+	return orphans, true
+}
+
+// chatRetainEdits removes the edit history of messages older than oldest and
+// of the edits in removed, and returns the number of edits removed. The caller
+// must hold the chat's lock.
+func chatRetainEdits(chatId string, oldest int64, removed map[int64]bool) (n int, ok bool) {
+	data, ok := dbRead("chat_edits", chatId)
+	if !ok {
+		return 0, true
+	}
+	kept := []byte{}
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		message := Message{}
+		chatMessage := ChatMessage{}
+		if json.Unmarshal(line, &message) == nil && json.Unmarshal(message.Data, &chatMessage) == nil &&
+			(chatMessage.EditForTimestamp < oldest || removed[chatMessage.EditForTimestamp]) {
+			// Edits of this edit go too
+			removed[chatMessage.Timestamp] = true
+			n++
+			continue
+		}
+		kept = append(append(kept, line...), '\n')
+	}
+	if n == 0 {
+		return 0, true
+	}
+	if len(kept) == 0 {
+		dbDelete("chat_edits", chatId)
+		return n, true
+	}
+	return n, dbWrite("chat_edits", chatId, kept)
+}
+
+// chatRetentionAll applies retention to every chat.
+func chatRetentionAll() {
+	chatIds, _ := dbKeys("chat_manifest")
+	for _, chatId := range chatIds {
+		if _, ok := chatApplyRetention(chatId); !ok {
+			myslog.Error("chat retention failed", "chatId", chatId)
+		}
+	}
+}
+
+// chatRetentionLoop applies retention to every chat every interval.
+func chatRetentionLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		chatRetentionAll()
+	}
+}
+
+// chatRetentionCommand runs the retention command: with no arguments it
+// applies retention to every chat, "set <chatId>" sets a chat's rule and
+// "clear <chatId>" removes it.
+func chatRetentionCommand(args []string) bool {
+	if len(args) == 0 {
+		chatRetentionAll()
+		return true
+	}
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	maxAge := flags.Duration("max-age", -1, "maximum message age, or 0 for no limit")
+	maxCount := flags.Int("max-count", -1, "maximum number of messages, or 0 for no limit")
+	if len(args) < 2 || flags.Parse(args[2:]) != nil || flags.NArg() != 0 || !chatValidId(args[1]) {
+		myslog.Error("usage: retention [set <chatId> [-max-age duration] [-max-count n] | clear <chatId>]")
+		return false
+	}
+	chatId := args[1]
+	switch args[0] {
+	case "set":
+		rule := chatRetention{}
+		if *maxAge >= 0 {
+			ms := maxAge.Milliseconds()
+			rule.MaxAge = &ms
+		}
+		if *maxCount >= 0 {
+			rule.MaxCount = maxCount
+		}
+		text, _ := json.Marshal(rule)
+		if !dbWrite("chat_retention", chatId, text) {
+			return false
+		}
+		myslog.Info("chat retention set", "chatId", chatId, "rule", string(text))
+	case "clear":
+		dbDelete("chat_retention", chatId)
+		myslog.Info("chat retention cleared", "chatId", chatId)
+	default:
+		myslog.Error("unknown retention command", "command", args[0])
+		return false
+	}
+	return true
+}
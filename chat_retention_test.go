@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testChatAppend appends a message to a chat, or an edit if editFor is set,
+// and returns its timestamp.
+func testChatAppend(t *testing.T, chatId, content string, editFor int64) int64 {
+	t.Helper()
+	message, ok := chatAppend(chatId, Message{UserId: "user", Action: NewChatMessageAction}, ChatMessage{Content: content, EditForTimestamp: editFor})
+	if !ok {
+		t.Fatal("chatAppend failed")
+	}
+	chatMessage := ChatMessage{}
+	json.Unmarshal(message.Data, &chatMessage)
+	return chatMessage.Timestamp
+}
+
+// testChatContents returns the content of every message in a chat, oldest
+// first.
+func testChatContents(t *testing.T, chatId string) []string {
+	t.Helper()
+	text, ok := chatQuery(chatId, nil, nil, nil, chatMaxLimit)
+	if !ok {
+		t.Fatal("chatQuery failed")
+	}
+	messages := []Message{}
+	if err := json.Unmarshal(text, &messages); err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, message := range messages {
+		chatMessage := ChatMessage{}
+		json.Unmarshal(message.Data, &chatMessage)
+		contents = append(contents, chatMessage.Content)
+	}
+	return contents
+}
+
+func testEqualStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChatRetentionCountsMessages(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+			chatId := "global"
+			m1 := testChatAppend(t, chatId, "m1", 0)
+			testChatAppend(t, chatId, "m2", 0)
+			e1 := testChatAppend(t, chatId, "e1", m1)
+			testChatAppend(t, chatId, "m3", 0)
+			// An edit of an edit of a message that is removed
+			e2 := testChatAppend(t, chatId, "e2", e1)
+			m4 := testChatAppend(t, chatId, "m4", 0)
+			e3 := testChatAppend(t, chatId, "e3", m4)
+			testChatAppend(t, chatId, "m5", 0)
+
+			// Edits moved to chat_edits by compaction
+			edits := []byte{}
+			for _, edit := range []ChatMessage{{Content: "e2", Timestamp: e2, EditForTimestamp: e1}, {Content: "z", Timestamp: e3 + 100, EditForTimestamp: e2}, {Content: "e3", Timestamp: e3, EditForTimestamp: m4}} {
+				message := Message{UserId: "user", Action: NewChatMessageAction}
+				message.Data, _ = json.Marshal(edit)
+				line, _ := json.Marshal(message)
+				edits = append(append(edits, line...), '\n')
+			}
+			dbAppend("chat_edits", chatId, edits)
+
+			dbWrite("chat_retention", chatId, []byte(`{"maxCount":3}`))
+			if _, ok := chatApplyRetention(chatId); !ok {
+				t.Fatal("chatApplyRetention failed")
+			}
+			want := []string{"m3", "m4", "e3", "m5"}
+			if got := testChatContents(t, chatId); !testEqualStrings(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if !chatIndexValid(chatId) {
+				t.Error("index doesn't match the log")
+			}
+			if n := chatIndexCount(chatId); n != len(want) {
+				t.Errorf("index has %d records, want %d", n, len(want))
+			}
+			text, _ := dbRead("chat_edits", chatId)
+			lines := []string{}
+			for _, line := range bytes.Split(bytes.TrimSuffix(text, []byte{'\n'}), []byte{'\n'}) {
+				message := Message{}
+				chatMessage := ChatMessage{}
+				json.Unmarshal(line, &message)
+				json.Unmarshal(message.Data, &chatMessage)
+				lines = append(lines, chatMessage.Content)
+			}
+			if !testEqualStrings(lines, []string{"e3"}) {
+				t.Errorf("chat_edits has %q, want [e3]", lines)
+			}
+
+			// Nothing more is removed
+			if removed, ok := chatApplyRetention(chatId); !ok || removed != 0 {
+				t.Errorf("chatApplyRetention = %d, %v, want 0, true", removed, ok)
+			}
+		})
+	}
+}
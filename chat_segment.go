@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A chat log is split into segments, each stored under its own key. The
+// manifest in chat_manifest lists a chat's segments in order. Offsets into a
+// chat log are logical: each segment starts at the logical offset where the
+// previous one ended, so offsets held by clients stay valid across segment
+// boundaries and when old segments are compressed or deleted.
+//
+// Only the last segment is written to. Once it grows past ChatSegmentSize or
+// ChatSegmentAge it is sealed and never modified again, which makes it safe
+// to compress into chat_archive or delete.
+type chatManifest struct {
+	Segments []chatSegment `json:"segments"`
+}
+
+type chatSegment struct {
+	// Key in chat_messages, or in chat_archive if the segment is compressed
+	Key  string `json:"key"`
+	Base int64  `json:"base"`
+	// Size is only kept for sealed segments. The size of the active segment
+	// is the size of its value.
+	Size       int64 `json:"size"`
+	Created    int64 `json:"created"`
+	Sealed     bool  `json:"sealed"`
+	Compressed bool  `json:"compressed"`
+	Deleted    bool  `json:"deleted"`
+	// Compacted segments have had edits folded into the messages they edit.
+	// They are shorter than the logical range they cover, so chat_linemap
+	// holds the logical and physical offset of each of their lines.
+	Compacted    bool  `json:"compacted"`
+	PhysicalSize int64 `json:"physicalSize"`
+	Generation   int   `json:"generation"`
+	// Number of logical bytes at the start of the segment whose messages
+	// were removed by a retention rule
+	Trimmed int64 `json:"trimmed"`
+}
+
+func chatReadManifest(chatId string) (chatManifest, bool) {
+	manifest := chatManifest{}
+	text, ok := dbRead("chat_manifest", chatId)
+	if !ok || json.Unmarshal(text, &manifest) != nil || len(manifest.Segments) == 0 {
+		return manifest, false
+	}
+	return manifest, true
+}
+
+func chatWriteManifest(chatId string, manifest chatManifest) bool {
+	text, err := json.Marshal(manifest)
+	return err == nil && dbWrite("chat_manifest", chatId, text)
+}
+
+func chatExists(chatId string) bool {
+	return dbExists("chat_manifest", chatId)
+}
+
+// chatValidId reports whether chatId can name a chat. Chat ids can't contain
+// "~", which separates the parts of segment keys, so a chat can't be named
+// after another chat's segment. Room is left for the parts.
+func chatValidId(chatId string) bool {
+	return dbValidKey(chatId) && len(chatId) <= dbMaxKeyLength-64 && !strings.Contains(chatId, "~")
+}
+
+// chatSegmentKey returns the key of a segment written for a chat, made of the
+// chat id and parts joined by "~".
+func chatSegmentKey(chatId string, parts ...any) string {
+	key := chatId
+	for _, part := range parts {
+		key += fmt.Sprint("~", part)
+	}
+	return key
+}
+
+// chatManifestInit creates a single-segment manifest for every chat log
+// written before logs were segmented. The old log becomes the first segment.
+func chatManifestInit(dryRun bool) error {
+	segmentKeys := map[string]bool{}
+	chatIds, _ := dbKeys("chat_manifest")
+	for _, chatId := range chatIds {
+		manifest, _ := chatReadManifest(chatId)
+		for _, segment := range manifest.Segments {
+			segmentKeys[segment.Key] = true
+		}
+	}
+	keys, _ := dbKeys("chat_messages")
+	for _, key := range keys {
+		if segmentKeys[key] || chatExists(key) || !chatValidId(key) {
+			continue
+		}
+		myslog.Info("chat manifest created", "chatId", key, "dryRun", dryRun)
+		if dryRun {
+			continue
+		}
+		manifest := chatManifest{Segments: []chatSegment{{Key: key, Created: time.Now().UnixMilli()}}}
+		if !chatWriteManifest(key, manifest) {
+			return fmt.Errorf("failed to write manifest for %q", key)
+		}
+	}
+	return nil
+}
+
+// chatLog is a view of a chat's segments that can be read by logical offset.
+type chatLog struct {
+	chatId   string
+	manifest chatManifest
+
+	// Decompressed data and line maps of the segments read so far
+	data     map[int][]byte
+	lineMaps map[int][]chatLineMapEntry
+}
+
+func openChatLog(chatId string) (*chatLog, bool) {
+	manifest, ok := chatReadManifest(chatId)
+	if !ok {
+		return nil, false
+	}
+	l := &chatLog{
+		chatId:   chatId,
+		manifest: manifest,
+		data:     map[int][]byte{},
+		lineMaps: map[int][]chatLineMapEntry{},
+	}
+	active := l.active()
+	active.Size, _ = dbSize("chat_messages", active.Key)
+	return l, true
+}
+
+func (l *chatLog) active() *chatSegment {
+	return &l.manifest.Segments[len(l.manifest.Segments)-1]
+}
+
+// start is the logical offset of the first byte that has not been deleted.
+func (l *chatLog) start() int64 {
+	for _, segment := range l.manifest.Segments {
+		if !segment.Deleted {
+			return segment.Base + segment.Trimmed
+		}
+	}
+	return l.size()
+}
+
+func (l *chatLog) size() int64 {
+	active := l.active()
+	return active.Base + active.Size
+}
+
+// physicalSize is the number of bytes stored for segment i.
+func (l *chatLog) physicalSize(i int) int64 {
+	segment := &l.manifest.Segments[i]
+	if segment.Compacted {
+		return segment.PhysicalSize
+	}
+	return segment.Size
+}
+
+// read reads up to length bytes of segment i starting at a physical offset.
+func (l *chatLog) read(i int, offset int64, length int) ([]byte, bool) {
+	segment := &l.manifest.Segments[i]
+	if !segment.Compressed {
+		return dbReadRange("chat_messages", segment.Key, offset, length)
+	}
+	data, ok := l.segmentData(i)
+	if !ok {
+		return nil, false
+	}
+	return readRange(bytes.NewReader(data), offset, length)
+}
+
+// segmentData reads all of the bytes stored for segment i.
+func (l *chatLog) segmentData(i int) ([]byte, bool) {
+	if data, ok := l.data[i]; ok {
+		return data, true
+	}
+	segment := &l.manifest.Segments[i]
+	if !segment.Compressed {
+		return dbRead("chat_messages", segment.Key)
+	}
+	compressed, ok := dbRead("chat_archive", segment.Key)
+	if !ok {
+		return nil, false
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, false
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+	l.data[i] = data
+	return data, true
+}
+
+// segmentLines calls fn with the logical offset of each complete line of
+// segment i.
+func (l *chatLog) segmentLines(i int, fn func(offset int64, line []byte)) bool {
+	segment := &l.manifest.Segments[i]
+	data, ok := l.segmentData(i)
+	if !ok {
+		return false
+	}
+	lineMap, ok := l.lineMap(i)
+	if !ok {
+		return false
+	}
+	for k, offset := 0, 0; offset < len(data); k++ {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			break
+		}
+		logical := int64(offset)
+		if segment.Compacted {
+			if k >= len(lineMap) {
+				return false
+			}
+			logical = lineMap[k].Logical
+		}
+		fn(segment.Base+logical, data[offset:offset+end])
+		offset += end + 1
+	}
+	return true
+}
+
+// translate finds the segment and physical offset that a logical offset
+// refers to.
+func (l *chatLog) translate(offset int64) (i int, physical int64, ok bool) {
+	if offset == l.size() {
+		i = len(l.manifest.Segments) - 1
+		return i, l.physicalSize(i), true
+	}
+	for i := range l.manifest.Segments {
+		segment := &l.manifest.Segments[i]
+		if offset < segment.Base || offset >= segment.Base+segment.Size {
+			continue
+		}
+		if segment.Deleted || offset < segment.Base+segment.Trimmed {
+			return 0, 0, false
+		}
+		if !segment.Compacted {
+			return i, offset - segment.Base, true
+		}
+		lineMap, ok := l.lineMap(i)
+		if !ok {
+			return 0, 0, false
+		}
+		physical, ok := lineMapTranslate(lineMap, offset-segment.Base, segment.PhysicalSize)
+		return i, physical, ok
+	}
+	return 0, 0, false
+}
+
+// chatLogReader is an io.ReadSeeker over a chat log for readEntries. Seeking
+// to offset 0 always starts at the oldest retained message, even after the
+// segments before it have been deleted.
+type chatLogReader struct {
+	log *chatLog
+	// Logical offset of the last seek
+	pos int64
+	// Current segment and physical offset within it
+	segment  int
+	physical int64
+}
+
+func (r *chatLogReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.log.size()
+	default:
+		return 0, errors.New("chatLogReader.Seek: invalid whence")
+	}
+	start := r.log.start()
+	if offset == 0 {
+		offset = start
+	}
+	if offset < start || offset > r.log.size() {
+		return 0, errors.New("chatLogReader.Seek: position outside of log")
+	}
+	segment, physical, ok := r.log.translate(offset)
+	if !ok {
+		return 0, errors.New("chatLogReader.Seek: position in deleted segment")
+	}
+	r.pos, r.segment, r.physical = offset, segment, physical
+	return offset, nil
+}
+
+func (r *chatLogReader) Read(p []byte) (n int, err error) {
+	for r.segment < len(r.log.manifest.Segments) {
+		remaining := r.log.physicalSize(r.segment) - r.physical
+		if r.log.manifest.Segments[r.segment].Deleted || remaining <= 0 {
+			r.segment++
+			r.physical = 0
+			continue
+		}
+		data, ok := r.log.read(r.segment, r.physical, int(min(int64(len(p)), remaining)))
+		if !ok || len(data) == 0 {
+			return 0, errors.New("chatLogReader.Read: failed to read segment")
+		}
+		n = copy(p, data)
+		r.physical += int64(n)
+		return n, nil
+	}
+	return 0, io.EOF
+}
+
+// chatReadEntries reads a JSON array of messages from a chat log by logical
+// byte offset. See readEntries.
+func chatReadEntries(chatId string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	l := chatLock(chatId)
+	l.RLock()
+	defer l.RUnlock()
+
+	log, ok := openChatLog(chatId)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	return readEntries(&chatLogReader{log: log}, offset, whence, total)
+}
+
+// chatRotate seals the active segment of a chat and starts a new one if it is
+// too big or too old. The caller must hold the chat's lock.
+func chatRotate(log *chatLog) bool {
+	active := log.active()
+	if active.Size == 0 {
+		return true
+	}
+	age := time.Since(time.UnixMilli(active.Created))
+	if active.Size < ChatSegmentSize && (ChatSegmentAge <= 0 || age < ChatSegmentAge) {
+		return true
+	}
+	key := active.Key
+	if !chatSeal(log) {
+		return false
+	}
+	if ChatCompressSegments {
+		go chatCompressSegment(log.chatId, key)
+	}
+	return true
+}
+
+// chatSeal seals the active segment of a chat and starts a new one. The caller
+// must hold the chat's lock.
+func chatSeal(log *chatLog) bool {
+	active := log.active()
+	active.Sealed = true
+	sealed := *active
+	next := chatSegment{
+		Key:     chatSegmentKey(log.chatId, len(log.manifest.Segments)),
+		Base:    active.Base + active.Size,
+		Created: time.Now().UnixMilli(),
+	}
+	log.manifest.Segments = append(log.manifest.Segments, next)
+	if !chatWriteManifest(log.chatId, log.manifest) {
+		return false
+	}
+	myslog.Info("chat segment sealed", "chatId", log.chatId, "key", sealed.Key, "size", sealed.Size)
+	return true
+}
+
+// chatCompressSegment moves a sealed segment into chat_archive, gzipped.
+func chatCompressSegment(chatId, key string) bool {
+	l := chatLock(chatId)
+
+	// Compress without holding the lock since sealed segments never change
+	l.RLock()
+	data, ok := dbRead("chat_messages", key)
+	l.RUnlock()
+	if !ok {
+		return false
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if w.Close() != nil || !dbWrite("chat_archive", key, buf.Bytes()) {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	manifest, ok := chatReadManifest(chatId)
+	if !ok {
+		return false
+	}
+	for i := range manifest.Segments {
+		segment := &manifest.Segments[i]
+		if segment.Key != key || !segment.Sealed || segment.Compressed || segment.Deleted {
+			continue
+		}
+		segment.Compressed = true
+		if !chatWriteManifest(chatId, manifest) {
+			dbDelete("chat_archive", key)
+			return false
+		}
+		dbDelete("chat_messages", key)
+		myslog.Info("chat segment compressed", "chatId", chatId, "key", key, "size", len(data), "compressedSize", buf.Len())
+		return true
+	}
+	dbDelete("chat_archive", key)
+	return false
+}
+
+// chatDeleteSegments deletes every sealed segment of a chat for which del
+// returns true. The caller must hold the chat's lock.
+func chatDeleteSegments(chatId string, del func(segment chatSegment) bool) (deleted int, ok bool) {
+	manifest, ok := chatReadManifest(chatId)
+	if !ok {
+		return 0, false
+	}
+	keys := []chatSegment{}
+	for i := range manifest.Segments {
+		segment := &manifest.Segments[i]
+		if segment.Sealed && !segment.Deleted && del(*segment) {
+			segment.Deleted = true
+			keys = append(keys, *segment)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, true
+	}
+	if !chatWriteManifest(chatId, manifest) {
+		return 0, false
+	}
+	if log, ok := openChatLog(chatId); ok {
+		chatIndexTrim(chatId, log.start())
+	}
+	for _, segment := range keys {
+		chatDeleteSegmentData(segment)
+	}
+	return len(keys), true
+}
+
+// chatDeleteSegmentData deletes everything stored for a segment that is no
+// longer in its chat's manifest.
+func chatDeleteSegmentData(segment chatSegment) {
+	if segment.Compressed {
+		dbDelete("chat_archive", segment.Key)
+	} else {
+		dbDelete("chat_messages", segment.Key)
+	}
+	if segment.Compacted {
+		dbDelete("chat_linemap", segment.Key)
+	}
+}
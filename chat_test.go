@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestLineMapTranslate(t *testing.T) {
+	// Lines at logical offsets 0 and 21 of a segment, with a 10 byte record
+	// at 11 folded away between them
+	lineMap := []chatLineMapEntry{{Logical: 0, Physical: 0}, {Logical: 21, Physical: 11}}
+	tests := []struct {
+		offset int64
+		want   int64
+	}{
+		{0, 0},
+		{5, 5},
+		// The newline of the first line
+		{10, 10},
+		// Inside the folded record
+		{11, 10},
+		{20, 10},
+		{21, 11},
+		{25, 15},
+	}
+	for _, test := range tests {
+		if got, ok := lineMapTranslate(lineMap, test.offset, 22); !ok || got != test.want {
+			t.Errorf("lineMapTranslate(%d) = %d, %v, want %d", test.offset, got, ok, test.want)
+		}
+	}
+
+	// A segment whose first lines were removed by retention
+	trimmed := []chatLineMapEntry{{Logical: 30, Physical: 0}}
+	if got, ok := lineMapTranslate(trimmed, 10, 10); !ok || got != 0 {
+		t.Errorf("lineMapTranslate before the first line = %d, %v, want 0", got, ok)
+	}
+}
+
+// testChatSeal seals the active segment of a chat.
+func testChatSeal(t *testing.T, chatId string) {
+	t.Helper()
+	l := chatLock(chatId)
+	l.Lock()
+	defer l.Unlock()
+	log, ok := openChatLog(chatId)
+	if !ok || !chatSeal(log) {
+		t.Fatal("chatSeal failed")
+	}
+}
+
+// testChatEntries reads a chat by logical byte offset like a client holding
+// an offset from before messages were indexed, and returns the content of the
+// messages.
+func testChatEntries(t *testing.T, chatId string, offset int64) []string {
+	t.Helper()
+	text, _, _, ok := chatReadEntries(chatId, offset, io.SeekCurrent, 1<<20)
+	if !ok {
+		t.Fatal("chatReadEntries failed")
+	}
+	messages := []Message{}
+	if err := json.Unmarshal(text, &messages); err != nil {
+		t.Fatalf("chatReadEntries returned %q: %v", text, err)
+	}
+	contents := []string{}
+	for _, message := range messages {
+		chatMessage := ChatMessage{}
+		json.Unmarshal(message.Data, &chatMessage)
+		contents = append(contents, chatMessage.Content)
+	}
+	return contents
+}
+
+// testChatOffsets returns the logical offset of each indexed message of a
+// chat by content.
+func testChatOffsets(t *testing.T, chatId string) map[string]int64 {
+	t.Helper()
+	records, ok := chatIndexRead(chatId, 0, chatIndexCount(chatId))
+	if !ok {
+		t.Fatal("chatIndexRead failed")
+	}
+	contents := testChatContents(t, chatId)
+	if len(contents) != len(records) {
+		t.Fatalf("%d index records for %d messages", len(records), len(contents))
+	}
+	offsets := map[string]int64{}
+	for k, record := range records {
+		offsets[contents[k]] = record.Offset
+	}
+	return offsets
+}
+
+// testChatCheck checks that a chat's index matches its log and that reading
+// from inside each message by logical offset returns the messages after it.
+// want must not be empty.
+func testChatCheck(t *testing.T, chatId string, want []string) {
+	t.Helper()
+	if !chatIndexValid(chatId) {
+		t.Error("index doesn't match the log")
+	}
+	if got := testChatContents(t, chatId); !testEqualStrings(got, want) {
+		t.Fatalf("messages are %q, want %q", got, want)
+	}
+	// Reading from inside the last message finds nothing, which readEntries
+	// returns as "]"
+	offsets := testChatOffsets(t, chatId)
+	for k, content := range want[:len(want)-1] {
+		if got := testChatEntries(t, chatId, offsets[content]+1); !testEqualStrings(got, want[k+1:]) {
+			t.Errorf("reading from inside %s got %q, want %q", content, got, want[k+1:])
+		}
+	}
+}
+
+func TestChatLog(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+			chatId := "global"
+
+			// Append
+			testChatAppend(t, chatId, "m1", 0)
+			m2 := testChatAppend(t, chatId, "m2", 0)
+			testChatAppend(t, chatId, "e1", m2)
+			testChatAppend(t, chatId, "m3", 0)
+			testChatCheck(t, chatId, []string{"m1", "m2", "e1", "m3"})
+
+			// Seal, compress the sealed segment and keep appending
+			testChatSeal(t, chatId)
+			if !chatCompressSegment(chatId, chatId) {
+				t.Fatal("chatCompressSegment failed")
+			}
+			m4 := testChatAppend(t, chatId, "m4", 0)
+			testChatAppend(t, chatId, "e2", m4)
+			testChatAppend(t, chatId, "m5", 0)
+			testChatSeal(t, chatId)
+			testChatAppend(t, chatId, "m6", 0)
+			testChatCheck(t, chatId, []string{"m1", "m2", "e1", "m3", "m4", "e2", "m5", "m6"})
+
+			log, ok := openChatLog(chatId)
+			if !ok {
+				t.Fatal("openChatLog failed")
+			}
+			if n := len(log.manifest.Segments); n != 3 {
+				t.Fatalf("%d segments, want 3", n)
+			}
+			offsets := testChatOffsets(t, chatId)
+			for content, segment := range map[string]int{"m1": 0, "m3": 0, "m4": 1, "m5": 1, "m6": 2} {
+				if i, physical, ok := log.translate(offsets[content]); !ok || i != segment || physical != offsets[content]-log.manifest.Segments[i].Base {
+					t.Errorf("translate(%s) = %d, %d, %v, want segment %d", content, i, physical, ok, segment)
+				}
+			}
+			r := &chatLogReader{log: log}
+			if end, err := r.Seek(0, io.SeekEnd); err != nil || end != log.size() {
+				t.Errorf("Seek to the end = %d, %v, want %d", end, err, log.size())
+			}
+			if _, err := r.Seek(1, io.SeekEnd); err == nil {
+				t.Error("Seek past the end succeeded")
+			}
+
+			// Compact, which gives m2 and m4 the content of their edits.
+			// Offsets from before still point at the same messages, and ones
+			// inside a folded edit at the message after it.
+			if folded, ok := chatCompact(chatId); !ok || folded != 2 {
+				t.Fatalf("chatCompact = %d, %v, want 2, true", folded, ok)
+			}
+			testChatCheck(t, chatId, []string{"m1", "e1", "m3", "e2", "m5", "m6"})
+			for content, want := range map[string][]string{
+				"m1": {"e1", "m3", "e2", "m5", "m6"},
+				"m2": {"m3", "e2", "m5", "m6"},
+				"e1": {"m3", "e2", "m5", "m6"},
+				"e2": {"m5", "m6"},
+			} {
+				if got := testChatEntries(t, chatId, offsets[content]+1); !testEqualStrings(got, want) {
+					t.Errorf("reading from inside %s after compaction got %q, want %q", content, got, want)
+				}
+			}
+
+			// Retention deletes the first segment and trims the second.
+			// Offsets in removed messages start at the oldest one kept.
+			dbWrite("chat_retention", chatId, []byte(`{"maxCount":2}`))
+			if _, ok := chatApplyRetention(chatId); !ok {
+				t.Fatal("chatApplyRetention failed")
+			}
+			testChatCheck(t, chatId, []string{"m5", "m6"})
+			for _, content := range []string{"m1", "e1", "m4", "e2"} {
+				if got := testChatEntries(t, chatId, offsets[content]+1); !testEqualStrings(got, []string{"m5", "m6"}) {
+					t.Errorf("reading from inside removed %s got %q, want [m5 m6]", content, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChatIndexValid(t *testing.T) {
+	testDbInit(t, "memory")
+	chatId := "global"
+	if chatIndexValid(chatId) {
+		t.Error("index of a missing chat is valid")
+	}
+	testChatAppend(t, chatId, "m1", 0)
+	testChatAppend(t, chatId, "m2", 0)
+	if !chatIndexValid(chatId) {
+		t.Fatal("index doesn't match the log")
+	}
+
+	// A torn record
+	dbAppend("chat_index", chatId, []byte{1, 2, 3})
+	if chatIndexValid(chatId) {
+		t.Error("index with a torn record is valid")
+	}
+	if !chatIndexRebuild(chatId) || !chatIndexValid(chatId) {
+		t.Error("rebuilt index doesn't match the log")
+	}
+
+	// A message that wasn't indexed
+	dbAppend("chat_messages", chatId, []byte(`{"data":{"content":"m3"}}`+"\n"))
+	if chatIndexValid(chatId) {
+		t.Error("index missing a message is valid")
+	}
+	chatIndexRebuild(chatId)
+	if n := chatIndexCount(chatId); n != 3 || !chatIndexValid(chatId) {
+		t.Errorf("rebuilt index has %d records, want 3", n)
+	}
+
+	// A missing index
+	dbDelete("chat_index", chatId)
+	if chatIndexValid(chatId) {
+		t.Error("missing index of a chat with messages is valid")
+	}
+}
+
+// TestChatSegmentKeys checks that a chat can't be named after another chat's
+// segment.
+func TestChatSegmentKeys(t *testing.T) {
+	testDbInit(t, "memory")
+	testChatAppend(t, "global", "m1", 0)
+	testChatSeal(t, "global")
+	testChatAppend(t, "global", "m2", 0)
+	log, ok := openChatLog("global")
+	if !ok {
+		t.Fatal("openChatLog failed")
+	}
+	key := log.active().Key
+	if key == "global" || chatValidId(key) {
+		t.Fatalf("segment key %q is a valid chat id", key)
+	}
+
+	// A client can't read the segment as a chat
+	c := testConnect(t, testHub())
+	limit := 10
+	if replies := c.replies(GetChatMessagesAction, GetChatMessages{ChatId: key, Limit: &limit}); len(replies) != 0 {
+		t.Errorf("reading chat %q got %d replies", key, len(replies))
+	}
+
+	// A segment left behind by a failed compaction doesn't become a chat
+	dbWrite("chat_messages", chatSegmentKey("global", 0, 1), []byte(`{"data":{"content":"m1"}}`+"\n"))
+	if err := chatManifestInit(false); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := dbKeys("chat_manifest"); !testEqualStrings(keys, []string{"global"}) {
+		t.Errorf("chats are %q, want global", keys)
+	}
+	testChatCheck(t, "global", []string{"m1", "m2"})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// dbCheck looks for inconsistencies between tables and malformed records and
+// logs each problem it finds. With repair set, the username index is rebuilt
+// from the user table, dangling references and orphaned records are deleted
+// and malformed chat log lines are blanked out. A problem only counts as
+// repaired once the write that repairs it has succeeded. It returns the number
+// of problems found that were not repaired.
+func dbCheck(repair bool) (problems int) {
+	report := func(repaired bool, problem string, args ...any) {
+		args = append([]any{"problem", problem, "repaired", repaired}, args...)
+		myslog.Warn("check", args...)
+		if !repaired {
+			problems++
+		}
+	}
+
+	// Users
+	users := map[string]User{}
+	values, _ := dbReadAll("user")
+	for userId, userText := range values {
+		user := User{}
+		if json.Unmarshal(userText, &user) != nil {
+			report(false, "invalid user JSON", "userId", userId)
+			continue
+		}
+		users[userId] = user
+	}
+
+	// Usernames: every user should own exactly the index entry for their
+	// username. Users already indexed under their name keep it when names
+	// are duplicated.
+	index := map[string]string{}
+	values, _ = dbReadAll("username_to_user_id")
+	for username, userId := range values {
+		index[username] = string(userId)
+	}
+	userIds := make([]string, 0, len(users))
+	for userId := range users {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	owners := map[string]string{}
+	for _, userId := range userIds {
+		if username := users[userId].Username; username != "" && index[username] == userId {
+			owners[username] = userId
+		}
+	}
+	for _, userId := range userIds {
+		user := users[userId]
+		if owners[user.Username] == userId {
+			continue
+		}
+		problem := "user has no username"
+		args := []any{"userId", userId}
+		if owner, ok := owners[user.Username]; ok {
+			problem = "duplicate username"
+			args = append(args, "username", user.Username, "otherUserId", owner)
+		} else if user.Username != "" {
+			owners[user.Username] = userId
+			continue
+		}
+		username, renamed := "", false
+		if repair {
+			username, renamed = checkRenameUser(userId)
+		}
+		if renamed {
+			args = append(args, "newUsername", username)
+			owners[username] = userId
+			index[username] = userId
+		}
+		report(renamed, problem, args...)
+	}
+	for username, userId := range index {
+		if owners[username] == userId {
+			continue
+		}
+		problem := "username not owned by user"
+		if _, ok := users[userId]; !ok {
+			problem = "username refers to missing user"
+		}
+		report(repair && dbDelete("username_to_user_id", username), problem, "username", username, "userId", userId)
+	}
+	for username, userId := range owners {
+		if index[username] != userId {
+			repaired := repair && dbWrite("username_to_user_id", username, []byte(userId))
+			report(repaired, "username missing from index", "username", username, "userId", userId)
+		}
+	}
+
+	// Tokens
+	values, _ = dbReadAll("token_to_user_id")
+	for token, userId := range values {
+		if _, ok := users[string(userId)]; !ok {
+			report(repair && dbDelete("token_to_user_id", token), "token refers to missing user", "userId", string(userId))
+		}
+	}
+
+	values, _ = dbReadAll("oidc_to_user_id")
+	for key, userId := range values {
+		if _, ok := users[string(userId)]; !ok {
+			report(repair && dbDelete("oidc_to_user_id", key), "OpenID Connect login refers to missing user", "userId", string(userId))
+		}
+	}
+
+	// Sessions
+	values, _ = dbReadAll("session")
+	for key, sessionText := range values {
+		session := Session{}
+		problem, args := "invalid session JSON", []any{"session", key}
+		if json.Unmarshal(sessionText, &session) == nil {
+			if _, ok := users[session.UserId]; ok {
+				continue
+			}
+			problem, args = "session of missing user", []any{"userId", session.UserId}
+		}
+		report(repair && dbDelete("session", key), problem, args...)
+	}
+
+	// Invites
+	values, _ = dbReadAll("invite")
+	for id, inviteText := range values {
+		invite := Invite{}
+		if json.Unmarshal(inviteText, &invite) != nil {
+			report(false, "invalid invite JSON", "id", id)
+			continue
+		}
+		if _, ok := users[invite.CreatedBy]; invite.CreatedBy != "" && !ok {
+			report(false, "invite created by missing user", "id", id, "userId", invite.CreatedBy)
+		}
+	}
+
+	// Passwords
+	values, _ = dbReadAll("password")
+	for userId, passwordText := range values {
+		problem := "password of missing user"
+		if _, ok := users[userId]; ok {
+			if json.Unmarshal(passwordText, &Password{}) == nil {
+				continue
+			}
+			problem = "invalid password JSON"
+		}
+		report(repair && dbDelete("password", userId), problem, "userId", userId)
+	}
+
+	// Two-factor authentication
+	values, _ = dbReadAll("totp")
+	for userId, totpText := range values {
+		problem := "totp of missing user"
+		if _, ok := users[userId]; ok {
+			if json.Unmarshal(totpText, &Totp{}) == nil {
+				continue
+			}
+			problem = "invalid totp JSON"
+		}
+		report(repair && dbDelete("totp", userId), problem, "userId", userId)
+	}
+
+	// Settings and developers
+	values, _ = dbReadAll("settings")
+	for userId, settingsText := range values {
+		problem := "settings of missing user"
+		if _, ok := users[userId]; ok {
+			if json.Unmarshal(settingsText, &MySettings{}) == nil {
+				continue
+			}
+			problem = "invalid settings JSON"
+		}
+		report(repair && dbDelete("settings", userId), problem, "userId", userId)
+	}
+	keys, _ := dbKeys("developer")
+	for _, userId := range keys {
+		if _, ok := users[userId]; !ok {
+			report(false, "developer is missing user", "userId", userId)
+		}
+	}
+
+	// Chat logs
+	if err := dbCheckManifests(db); err != nil {
+		report(false, err.Error())
+	}
+	chatIds, _ := dbKeys("chat_manifest")
+	for _, chatId := range chatIds {
+		if checkChat(chatId, repair, report) && repair {
+			chatIndexRebuild(chatId)
+		}
+		if !chatIndexValid(chatId) {
+			repaired := repair && chatIndexRebuild(chatId) && chatIndexValid(chatId)
+			report(repaired, "chat index does not match log", "chatId", chatId)
+		}
+	}
+
+	return problems
+}
+
+func checkRenameUser(userId string) (string, bool) {
+	for i := 0; i < 10; i++ {
+		username := randomUsername()
+		if !dbCreate("username_to_user_id", username, []byte(userId)) {
+			continue
+		}
+		ok := dbUpdate("user", userId, func(userText []byte, ok bool) ([]byte, bool) {
+			user := User{}
+			if !ok || json.Unmarshal(userText, &user) != nil {
+				return nil, false
+			}
+			user.Username = username
+			user.ChangedUsername = false
+			userText, err := json.Marshal(user)
+			return userText, err == nil
+		})
+		if !ok {
+			dbDelete("username_to_user_id", username)
+			return "", false
+		}
+		return username, true
+	}
+	return "", false
+}
+
+// checkChat reports lines of a chat log that aren't a valid message. They are
+// repaired by overwriting them with a JSON object of the same length so that
+// offsets into the log don't change, except in compressed segments, which
+// can't be rewritten. It reports whether anything was repaired.
+func checkChat(chatId string, repair bool, report func(repaired bool, problem string, args ...any)) bool {
+	log, ok := openChatLog(chatId)
+	if !ok {
+		report(false, "invalid chat manifest", "chatId", chatId)
+		return false
+	}
+	repaired := false
+	for i, segment := range log.manifest.Segments {
+		if segment.Deleted {
+			continue
+		}
+		data, ok := log.segmentData(i)
+		if !ok {
+			continue
+		}
+		// Lines of the segment that are blanked out
+		bad := []int{}
+		line := 0
+		for offset := 0; offset < len(data); line++ {
+			end := bytes.IndexByte(data[offset:], '\n')
+			if end < 0 {
+				report(false, "incomplete last line", "chatId", chatId, "segment", segment.Key)
+				break
+			}
+			// Empty lines are skipped by readers
+			message := Message{}
+			if end > 0 && json.Unmarshal(data[offset:offset+end], &message) != nil {
+				if repair && end >= 2 && !segment.Compressed {
+					blank := bytes.Repeat([]byte{' '}, end)
+					blank[0], blank[end-1] = '{', '}'
+					copy(data[offset:], blank)
+					bad = append(bad, line+1)
+				} else {
+					report(false, "invalid chat message", "chatId", chatId, "segment", segment.Key, "line", line+1, "compressed", segment.Compressed)
+				}
+			}
+			offset += end + 1
+		}
+		if len(bad) == 0 {
+			continue
+		}
+		written := dbWrite("chat_messages", segment.Key, data)
+		for _, line := range bad {
+			report(written, "invalid chat message", "chatId", chatId, "segment", segment.Key, "line", line)
+		}
+		repaired = repaired || written
+	}
+	return repaired
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testCheckGarbage appends a line that isn't a message to the active segment
+// of a chat, between two messages so that the index still matches the log.
+func testCheckGarbage(t *testing.T, chatId string) {
+	t.Helper()
+	testChatAppend(t, chatId, "m1", 0)
+	manifest, _ := chatReadManifest(chatId)
+	if !dbAppend("chat_messages", manifest.Segments[len(manifest.Segments)-1].Key, []byte("garbage!\n")) {
+		t.Fatal("dbAppend failed")
+	}
+	testChatAppend(t, chatId, "m2", 0)
+}
+
+// testCheckSeed writes one of each kind of inconsistency dbCheck looks for
+// and returns the number of problems it can't repair.
+func testCheckSeed(t *testing.T) (unrepairable int) {
+	t.Helper()
+	user := func(userId, username string) {
+		userText, _ := json.Marshal(User{Username: username})
+		dbWrite("user", userId, userText)
+	}
+	session := func(key, userId string) {
+		sessionText, _ := json.Marshal(Session{UserId: userId})
+		dbWrite("session", key, sessionText)
+	}
+
+	// Users and usernames
+	user("u1", "alice")
+	dbWrite("username_to_user_id", "alice", []byte("u1"))
+	user("u2", "")
+	user("u3", "alice")
+	user("u4", "bob")
+	dbWrite("username_to_user_id", "ghost", []byte("missing"))
+	dbWrite("username_to_user_id", "old", []byte("u1"))
+	dbWrite("user", "bad", []byte("{"))
+
+	// Records of missing users and invalid records
+	dbWrite("token_to_user_id", "token", []byte("missing"))
+	dbWrite("oidc_to_user_id", "oidc", []byte("missing"))
+	session("s1", "u1")
+	session("s2", "missing")
+	dbWrite("session", "s3", []byte("{"))
+	for _, table := range []string{"password", "totp", "settings"} {
+		dbWrite(table, "missing", []byte("{}"))
+		dbWrite(table, "u1", []byte("{"))
+	}
+	dbWrite("invite", "i1", []byte("{"))
+	inviteText, _ := json.Marshal(Invite{CreatedBy: "missing"})
+	dbWrite("invite", "i2", inviteText)
+	dbWrite("developer", "missing", []byte("true"))
+
+	// Chat logs: a bad line in a plain segment, a bad line in a compressed
+	// segment and an index that doesn't match its log
+	testCheckGarbage(t, "plain")
+	testCheckGarbage(t, "compressed")
+	testChatSeal(t, "compressed")
+	if !chatCompressSegment("compressed", "compressed") {
+		t.Fatal("chatCompressSegment failed")
+	}
+	testChatAppend(t, "unindexed", "m1", 0)
+	dbDelete("chat_index", "unindexed")
+
+	// The invalid user, both invites, the developer and the compressed line
+	return 5
+}
+
+func TestCheck(t *testing.T) {
+	testDbInit(t, "memory")
+	unrepairable := testCheckSeed(t)
+	if problems := dbCheck(false); problems != 22 {
+		t.Errorf("dbCheck(false) = %d, want 22", problems)
+	}
+	if problems := dbCheck(true); problems != unrepairable {
+		t.Errorf("dbCheck(true) = %d, want %d", problems, unrepairable)
+	}
+	if problems := dbCheck(false); problems != unrepairable {
+		t.Errorf("dbCheck(false) after repair = %d, want %d", problems, unrepairable)
+	}
+
+	// The index matches the users
+	for _, userId := range []string{"u1", "u2", "u3", "u4"} {
+		userText, _ := dbRead("user", userId)
+		user := User{}
+		json.Unmarshal(userText, &user)
+		if owner, _ := dbRead("username_to_user_id", user.Username); user.Username == "" || string(owner) != userId {
+			t.Errorf("%s has username %q owned by %q", userId, user.Username, owner)
+		}
+	}
+	for _, username := range []string{"ghost", "old"} {
+		if dbExists("username_to_user_id", username) {
+			t.Errorf("username %s is still indexed", username)
+		}
+	}
+
+	// Orphans and invalid records are gone, everything else is kept
+	for _, record := range [][2]string{
+		{"token_to_user_id", "token"}, {"oidc_to_user_id", "oidc"}, {"session", "s2"}, {"session", "s3"},
+		{"password", "missing"}, {"password", "u1"}, {"totp", "missing"}, {"totp", "u1"},
+		{"settings", "missing"}, {"settings", "u1"},
+	} {
+		if dbExists(record[0], record[1]) {
+			t.Errorf("%s %s wasn't deleted", record[0], record[1])
+		}
+	}
+	for _, record := range [][2]string{{"session", "s1"}, {"user", "bad"}, {"invite", "i1"}, {"invite", "i2"}, {"developer", "missing"}} {
+		if !dbExists(record[0], record[1]) {
+			t.Errorf("%s %s was deleted", record[0], record[1])
+		}
+	}
+
+	// The bad line is blanked out without moving the messages after it
+	if data, _ := dbRead("chat_messages", "plain"); !strings.Contains(string(data), "\n{      }\n") {
+		t.Errorf("bad line wasn't blanked out in %q", data)
+	}
+	if got := testChatContents(t, "plain"); !testEqualStrings(got, []string{"m1", "m2"}) || !chatIndexValid("plain") {
+		t.Errorf("plain chat has %q after repair", got)
+	}
+	testChatCheck(t, "unindexed", []string{"m1"})
+}
+
+// TestCheckFailedRepair checks that problems aren't counted as repaired when
+// the writes that would repair them fail.
+func TestCheckFailedRepair(t *testing.T) {
+	testDbInit(t, "memory")
+	testCheckSeed(t)
+	db = readOnlyStore{db}
+	if problems := dbCheck(true); problems != 22 {
+		t.Errorf("dbCheck(true) = %d on a read-only store, want 22", problems)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"regexp"
 	"strings"
@@ -30,6 +31,10 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 4096
+
+	// Time allowed for a client that wasn't authenticated during the
+	// handshake to send its first message.
+	helloWait = 10 * time.Second
 )
 
 var (
@@ -56,15 +61,20 @@ type Client struct {
 	send chan []byte
 
 	// Extra data for each connection.
-	userId string
-	peerId string
+	userId    string
+	sessionId string
+	peerId    string
+
+	// The session the client is bound to and when it was last checked.
+	sessionToken   string
+	sessionChecked time.Time
 }
 
 var nClients = sync.Map{}
 var presences = sync.Map{}
 var peerMap = sync.Map{}
 
-var developers, _ = dbReadAll("developer")
+var developers map[string]([]byte)
 
 // readPump pumps messages from the websocket connection to the hub.
 //
@@ -97,55 +107,66 @@ func (c *Client) readPump() {
 			}
 			myslog.Info("disconnect", "userId", c.userId, "openConnections", n-1)
 		}
-		c.hub.unregister <- c
+		if c.userId != "" {
+			c.hub.unregister <- c
+		} else {
+			// The hub never knew about this client
+			close(c.send)
+		}
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
+
+	// Clients that weren't authenticated by serveWs must send a valid session
+	// token in their first message, which is then handled like any other
+	// message.
+	var hello []byte
+	if c.userId == "" {
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.helloWait))
 		_, messageText, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
+			return
 		}
-
-		messageText = bytes.TrimSpace(bytes.Replace(messageText, newline, space, -1))
-
-		// Ensure message has session token
 		incomingMessage := IncomingMessage{}
-		err = json.Unmarshal(messageText, &incomingMessage)
-		if err != nil || incomingMessage.SessionToken == "" {
-			continue
+		json.Unmarshal(messageText, &incomingMessage)
+		userId, ok := getUserId(incomingMessage.SessionToken)
+		if !ok {
+			c.disconnect("unauthorized")
+			return
 		}
-
-		// Validate session token
-		token := getToken(incomingMessage.SessionToken)
-		if token == "" {
-			continue
+		c.bind(userId, incomingMessage.SessionToken)
+		hello = messageText
+	}
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	for {
+		messageText, err := hello, error(nil)
+		hello = nil
+		if messageText == nil {
+			_, messageText, err = c.conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Printf("error: %v", err)
+				}
+				break
+			}
 		}
 
-		// Get user info
-		userId, ok := dbRead("token_to_user_id", token)
-		if !ok {
-			continue
-		}
+		messageText = bytes.TrimSpace(bytes.Replace(messageText, newline, space, -1))
 
-		// Save this client's userId and increment nClients
-		if c.userId == "" {
-			c.userId = string(userId)
-			if n, ok := nClients.Load(c.userId); ok {
-				n := n.(int)
-				nClients.Store(c.userId, n+1)
-			} else {
-				nClients.Store(c.userId, 1)
+		// Check the session now and then so that the client is disconnected
+		// once it expires
+		if time.Since(c.sessionChecked) >= sessionTouchInterval {
+			if _, ok := sessions.Get(c.sessionToken); !ok {
+				c.disconnect("session expired")
+				break
 			}
+			c.sessionChecked = time.Now()
 		}
+		userId := c.userId
 
 		// Get this user's infor from the db
-		userText, ok := dbRead("user", string(userId))
+		userText, ok := dbRead("user", userId)
 		if !ok {
 			continue
 		}
@@ -160,7 +181,7 @@ func (c *Client) readPump() {
 		if err != nil || message.Action <= 0 {
 			continue
 		}
-		message.UserId = string(userId)
+		message.UserId = userId
 
 		// Save this user's presence as online
 		if _, ok := presences.Load(message.UserId); !ok {
@@ -176,20 +197,18 @@ func (c *Client) readPump() {
 			r := NewChatMessage{}
 			err = json.Unmarshal(message.Data, &r)
 			r.Data.Content = strings.TrimSpace(r.Data.Content)
-			if err != nil || r.Data.Content == "" || r.ChatId == "" {
+			if err != nil || r.Data.Content == "" || !chatValidId(r.ChatId) {
 				continue
 			}
-			if r.ChatId != "global" && !dbExists("chat_messages", r.ChatId) {
+			if r.ChatId != "global" && !chatExists(r.ChatId) {
 				continue
 			}
 
-			r.Data.Timestamp = time.Now().UnixMilli()
-			message.Data, _ = json.Marshal(r.Data)
-
 			// Save new chat message to db
-			dbMessage, _ := json.Marshal(message)
-			dbMessage = append(dbMessage, "\n"...)
-			dbAppend("chat_messages", "global", []byte(dbMessage))
+			message, ok = chatAppend("global", message, r.Data)
+			if !ok {
+				continue
+			}
 		} else if message.Action == ChangeUsernameAction {
 			// Parse and validate username
 			r := ChangeUsername{}
@@ -211,20 +230,30 @@ func (c *Client) readPump() {
 				continue
 			}
 
-			// Ensure username is not already taken
-			if _, ok := dbRead("username_to_user_id", r.Username); ok {
+			// Claim the new username, which fails if it is already taken
+			if !dbCreate("username_to_user_id", r.Username, []byte(message.UserId)) {
 				continue
 			}
 
 			// Save new username and delete old one
-			dbWrite("username_to_user_id", r.Username, []byte(message.UserId))
-			dbDelete("username_to_user_id", user.Username)
-			if !user.ChangedUsername {
-				user.ChangedUsername = (user.Username != r.Username)
-			}
-			user.Username = r.Username
-			userText, _ = json.Marshal(user)
-			dbWrite("user", message.UserId, userText)
+			oldUsername := ""
+			ok := dbUpdate("user", message.UserId, func(userText []byte, ok bool) ([]byte, bool) {
+				if !ok || json.Unmarshal(userText, &user) != nil {
+					return nil, false
+				}
+				oldUsername = user.Username
+				if !user.ChangedUsername {
+					user.ChangedUsername = (user.Username != r.Username)
+				}
+				user.Username = r.Username
+				userText, err := json.Marshal(user)
+				return userText, err == nil
+			})
+			if !ok {
+				dbDelete("username_to_user_id", r.Username)
+				continue
+			}
+			dbDelete("username_to_user_id", oldUsername)
 		} else if message.Action == RequestUserInfoAction {
 			broadcast = false
 
@@ -269,33 +298,47 @@ func (c *Client) readPump() {
 			if json.Unmarshal(message.Data, &r) != nil {
 				continue
 			}
-			if r.ChatId == "" {
-				continue
-			}
-			if r.Total == nil {
+			if !chatValidId(r.ChatId) {
 				continue
 			}
 
-			// If a start value is not provided, assume we are seeking from the end of the file
-			var offset int64
-			var whence int
-			if r.Start == nil {
-				offset = -int64(*r.Total)
-				whence = io.SeekEnd
+			// Page through the chat by message timestamp using the chat index
+			if r.Limit != nil {
+				if *r.Limit <= 0 {
+					continue
+				}
+				if entries, ok := chatQuery(r.ChatId, r.Before, r.After, r.Since, *r.Limit); ok {
+					r.Messages = entries
+				} else {
+					r.Messages = []byte("[]")
+				}
+				message.Data, _ = json.Marshal(r)
 			} else {
-				offset = *r.Start
-				whence = io.SeekCurrent
-			}
-			entries, newOffset, newTotal, ok := dbReadEntries("chat_messages", r.ChatId, offset, whence, *r.Total)
+				if r.Total == nil {
+					continue
+				}
 
-			if ok {
-				r.Start = &newOffset
-				r.Total = &newTotal
-				r.Messages = entries
-			} else {
-				r.Messages = []byte("[]")
+				// If a start value is not provided, assume we are seeking from the end of the log
+				var offset int64
+				var whence int
+				if r.Start == nil {
+					offset = -int64(*r.Total)
+					whence = io.SeekEnd
+				} else {
+					offset = *r.Start
+					whence = io.SeekCurrent
+				}
+				entries, newOffset, newTotal, ok := chatReadEntries(r.ChatId, offset, whence, *r.Total)
+
+				if ok {
+					r.Start = &newOffset
+					r.Total = &newTotal
+					r.Messages = entries
+				} else {
+					r.Messages = []byte("[]")
+				}
+				message.Data, _ = json.Marshal(r)
 			}
-			message.Data, _ = json.Marshal(r)
 		} else if message.Action == UpdateMyUserInfoAction {
 			// Parse and validate request
 			r := User{}
@@ -305,31 +348,42 @@ func (c *Client) readPump() {
 
 			if r.Presence > 0 {
 				presences.Store(message.UserId, r.Presence)
-				user.Presence = r.Presence
-			} else if presence, ok := presences.Load(message.UserId); ok {
-				user.Presence = presence.(uint8)
-			}
-			if r.Status != "" {
-				user.Status = r.Status
-			}
-			if r.Status != "" {
-				user.Icon = r.Icon
-			}
-			if r.BannerUrl != "" {
-				user.BannerUrl = r.BannerUrl
-			}
-			if r.UsernameColor != "" {
-				user.UsernameColor = r.UsernameColor
-			}
-			user.IsDeveloper = false
-			if developers != nil && developers[message.UserId] != nil {
-				user.IsDeveloper = true
 			}
 
-			if updatedUserText, err := json.Marshal(user); err == nil {
-				dbWrite("user", message.UserId, updatedUserText)
+			ok := dbUpdate("user", message.UserId, func(userText []byte, ok bool) ([]byte, bool) {
+				if !ok || json.Unmarshal(userText, &user) != nil {
+					return nil, false
+				}
+				if r.Presence > 0 {
+					user.Presence = r.Presence
+				} else if presence, ok := presences.Load(message.UserId); ok {
+					user.Presence = presence.(uint8)
+				}
+				if r.Status != "" {
+					user.Status = r.Status
+				}
+				if r.Status != "" {
+					user.Icon = r.Icon
+				}
+				if r.BannerUrl != "" {
+					user.BannerUrl = r.BannerUrl
+				}
+				if r.UsernameColor != "" {
+					user.UsernameColor = r.UsernameColor
+				}
+				user.IsDeveloper = false
+				if developers != nil && developers[message.UserId] != nil {
+					user.IsDeveloper = true
+				}
+
+				updatedUserText, err := json.Marshal(user)
+				if err != nil {
+					return nil, false
+				}
 				message.Data = updatedUserText
-			} else {
+				return updatedUserText, true
+			})
+			if !ok {
 				continue
 			}
 		} else if message.Action == GetAllUsersAction {
@@ -409,50 +463,171 @@ func (c *Client) readPump() {
 
 			settingsText, _ := json.Marshal(r)
 			dbWrite("settings", message.UserId, settingsText)
-		} else if message.Action == EditChatMessageAction {
-			r := EditChatMessage{}
-			err = json.Unmarshal(message.Data, &r)
-			r.Data.Content = strings.TrimSpace(r.Data.Content)
-			if err != nil || r.Data.Content == "" || r.ChatId == "" || r.Data.EditForTimestamp == 0 || r.Total == 0 {
+		} else if message.Action == LogoutAction {
+			// The hub disconnects every client of the session, including
+			// this one
+			if sessionId, ok := sessions.Delete(c.sessionToken); ok {
+				myslog.Info("logout", "userId", message.UserId)
+				c.hub.revoke <- sessionId
+			}
+			continue
+		} else if message.Action == GetMySessionsAction {
+			broadcast = false
+
+			r := GetMySessions{Sessions: sessions.List(message.UserId)}
+			for i := range r.Sessions {
+				r.Sessions[i].Current = r.Sessions[i].Id == c.sessionId
+			}
+			message.Data, _ = json.Marshal(r)
+		} else if message.Action == RevokeSessionAction {
+			broadcast = false
+
+			r := RevokeSession{}
+			if json.Unmarshal(message.Data, &r) != nil || r.Id == "" {
+				continue
+			}
+			if !sessions.Revoke(message.UserId, r.Id) {
 				continue
 			}
-			if _, ok := dbRead("chat_messages", r.ChatId); !ok {
+			myslog.Info("session revoked", "userId", message.UserId)
+			c.hub.revoke <- r.Id
+			if r.Id == c.sessionId {
 				continue
 			}
+			message.Data, _ = json.Marshal(r)
+		} else if message.Action == ChangePasswordAction {
+			broadcast = false
 
-			entries, _, _, ok := dbReadEntries("chat_messages", r.ChatId, r.Start, io.SeekCurrent, r.Total)
+			r := ChangePassword{}
+			if json.Unmarshal(message.Data, &r) != nil || !validPassword(r.NewPassword) {
+				continue
+			}
+			if hasPassword(message.UserId) && !checkPassword(message.UserId, r.CurrentPassword) {
+				myslog.Info("wrong password", "userId", message.UserId)
+				continue
+			}
+			if !setPassword(message.UserId, r.NewPassword) {
+				continue
+			}
+			myslog.Info("password changed", "userId", message.UserId)
+
+			// Don't send the passwords back
+			message.Data, _ = json.Marshal(ChangePassword{})
+		} else if message.Action == ResetPasswordAction {
+			r := ResetPassword{}
+			if !isDeveloper(message.UserId) || json.Unmarshal(message.Data, &r) != nil || !dbValidKey(r.UserId) || !dbExists("user", r.UserId) {
+				continue
+			}
+			password, ok := resetPassword(r.UserId)
 			if !ok {
 				continue
 			}
-			dbMessages := []Message{}
-			if json.Unmarshal(entries, &dbMessages) != nil {
+			myslog.Info("password reset", "userId", r.UserId, "developerId", message.UserId)
+
+			// Sent here so that the new password isn't logged
+			r.Password = password
+			message.Data, _ = json.Marshal(r)
+			messageText, _ = json.Marshal(message)
+			c.send <- messageText
+			continue
+		} else if message.Action == EnrollTotpAction {
+			uri, recoveryCodes, ok := totpEnroll(message.UserId, user.Username)
+			if !ok {
 				continue
 			}
+			myslog.Info("totp enrollment started", "userId", message.UserId)
 
-			chatMessage := ChatMessage{}
-			found := false
-			for _, dbMessage := range dbMessages {
-				err = json.Unmarshal(dbMessage.Data, &chatMessage)
-				if err != nil {
-					break
-				}
-				if chatMessage.Timestamp == r.Data.EditForTimestamp && dbMessage.UserId == message.UserId {
-					found = true
-					break
-				}
+			// Sent here so that the secret isn't logged
+			message.Data, _ = json.Marshal(EnrollTotp{Uri: uri, RecoveryCodes: recoveryCodes})
+			messageText, _ = json.Marshal(message)
+			c.send <- messageText
+			continue
+		} else if message.Action == ConfirmTotpAction {
+			broadcast = false
+
+			r := TotpCode{}
+			if json.Unmarshal(message.Data, &r) != nil || !totpConfirm(message.UserId, r.Code) {
+				continue
 			}
-			if !found {
+			myslog.Info("totp enabled", "userId", message.UserId)
+
+			// Sessions that were signed in without a code end, so every
+			// session left has passed two-factor authentication
+			for _, sessionId := range sessions.RevokeOthers(message.UserId, c.sessionId) {
+				c.hub.revoke <- sessionId
+			}
+			message.Data, _ = json.Marshal(TotpCode{})
+		} else if message.Action == DisableTotpAction {
+			broadcast = false
+
+			r := TotpCode{}
+			if json.Unmarshal(message.Data, &r) != nil || !totpCheck(message.UserId, r.Code) {
 				continue
 			}
+			totpReset(message.UserId)
+			myslog.Info("totp disabled", "userId", message.UserId)
+			message.Data, _ = json.Marshal(TotpCode{})
+		} else if message.Action == ResetTotpAction {
+			broadcast = false
 
-			r.Data.Timestamp = time.Now().UnixMilli()
+			r := ResetTotp{}
+			if !isDeveloper(message.UserId) || json.Unmarshal(message.Data, &r) != nil || !dbValidKey(r.UserId) || !dbExists("totp", r.UserId) {
+				continue
+			}
+			totpReset(r.UserId)
+			myslog.Info("totp reset", "userId", r.UserId, "developerId", message.UserId)
+		} else if message.Action == CreateInviteAction {
+			r := CreateInvite{}
+			// Expiry times longer than a time.Duration can hold are rejected
+			if !isDeveloper(message.UserId) || json.Unmarshal(message.Data, &r) != nil || r.ExpiresIn > time.Duration(math.MaxInt64).Milliseconds() {
+				continue
+			}
+			invite, code, id, ok := invites.Create(message.UserId, r.MaxUses, time.Duration(r.ExpiresIn)*time.Millisecond)
+			if !ok {
+				continue
+			}
+			r.Expires, r.Code, r.Id = invite.Expires, code, id
+			myslog.Info("invite created", "id", r.Id, "developerId", message.UserId, "maxUses", r.MaxUses, "expires", r.Expires)
+
+			// Sent here so that the code isn't logged
+			message.Data, _ = json.Marshal(r)
+			messageText, _ = json.Marshal(message)
+			c.send <- messageText
+			continue
+		} else if message.Action == GetInvitesAction {
+			broadcast = false
+
+			if !isDeveloper(message.UserId) {
+				continue
+			}
+			message.Data, _ = json.Marshal(GetInvites{Invites: invites.List()})
+		} else if message.Action == RevokeInviteAction {
+			broadcast = false
+
+			r := RevokeInvite{}
+			if !isDeveloper(message.UserId) || json.Unmarshal(message.Data, &r) != nil || !dbValidKey(r.Id) || !invites.Revoke(r.Id) {
+				continue
+			}
+			myslog.Info("invite revoked", "id", r.Id, "developerId", message.UserId)
+		} else if message.Action == EditChatMessageAction {
+			r := EditChatMessage{}
+			err = json.Unmarshal(message.Data, &r)
+			r.Data.Content = strings.TrimSpace(r.Data.Content)
+			if err != nil || r.Data.Content == "" || !chatValidId(r.ChatId) || r.Data.EditForTimestamp == 0 {
+				continue
+			}
 
-			message.Data, _ = json.Marshal(r.Data)
+			// Only the author of a message can edit it
+			original, _, ok := chatFind(r.ChatId, r.Data.EditForTimestamp)
+			if !ok || original.UserId != message.UserId {
+				continue
+			}
 
 			// Save new chat message to db
-			dbMessage, _ := json.Marshal(message)
-			dbMessage = append(dbMessage, "\n"...)
-			dbAppend("chat_messages", "global", []byte(dbMessage))
+			message, ok = chatAppend("global", message, r.Data)
+			if !ok {
+				continue
+			}
 		}
 
 		messageText, _ = json.Marshal(message)
@@ -468,6 +643,30 @@ func (c *Client) readPump() {
 	}
 }
 
+// bind ties the client to a user's session and registers it with the hub,
+// which starts sending it broadcasts.
+func (c *Client) bind(userId, sessionToken string) {
+	c.userId = userId
+	c.sessionToken = sessionToken
+	c.sessionId = hashToken(sessionToken)
+	c.sessionChecked = time.Now()
+	if n, ok := nClients.Load(c.userId); ok {
+		n := n.(int)
+		nClients.Store(c.userId, n+1)
+	} else {
+		nClients.Store(c.userId, 1)
+	}
+	c.hub.register <- c
+}
+
+// disconnect closes the connection with a reason, which ends its readPump and
+// unregisters the client. It is safe to call from any goroutine.
+func (c *Client) disconnect(reason string) {
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -517,13 +716,26 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	// Browsers can't set headers on WebSocket requests, so clients that don't
+	// send Authorization authenticate with their first message instead
+	sessionToken := r.Header.Get("Authorization")
+	userId := ""
+	if sessionToken != "" {
+		var ok bool
+		if userId, ok = getUserId(sessionToken); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	if userId != "" {
+		client.bind(userId, sessionToken)
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
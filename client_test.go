@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a websocket connection to a test server, logged in as a new
+// user.
+type testClient struct {
+	t            *testing.T
+	conn         *websocket.Conn
+	userId       string
+	sessionToken string
+}
+
+// testHub starts a hub.
+func testHub() *Hub {
+	hub := newHub()
+	go hub.run()
+	return hub
+}
+
+// testServer starts a test server that uses hub and returns its websocket
+// URL.
+func testServer(t *testing.T, hub *Hub) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// testConnect connects a new user to a test server that uses hub.
+func testConnect(t *testing.T, hub *Hub) *testClient {
+	t.Helper()
+	url := testServer(t, hub)
+	userId, ok := createUser()
+	if !ok {
+		t.Fatal("createUser failed")
+	}
+	dbWrite("settings", userId, []byte(`{}`))
+	sessionToken, ok := sessions.Create(userId, "test", "127.0.0.1")
+	if !ok {
+		t.Fatal("sessions.Create failed")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {sessionToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user going offline is broadcast after the server's last store
+	// access for the connection, so the test waits for it before its store
+	// is closed
+	observer := &Client{hub: hub, send: make(chan []byte, 256)}
+	hub.register <- observer
+	offline := make(chan struct{})
+	go func() {
+		for text := range observer.send {
+			message := Message{}
+			user := User{}
+			if json.Unmarshal(text, &message) == nil && message.Action == UpdateMyUserInfoAction && message.UserId == userId &&
+				json.Unmarshal(message.Data, &user) == nil && user.Presence == OfflinePresence {
+				close(offline)
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		select {
+		case <-offline:
+		case <-time.After(5 * time.Second):
+			t.Error("server didn't close the connection")
+		}
+	})
+	return &testClient{t: t, conn: conn, userId: userId, sessionToken: sessionToken}
+}
+
+func (c *testClient) send(action uint8, data any) {
+	c.t.Helper()
+	text, _ := json.Marshal(data)
+	if err := c.conn.WriteJSON(Message{Action: action, Data: text}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// replies sends a message and returns every reply to it. It finds the end of
+// the replies by sending GetMySettingsAction after it and waiting for that
+// reply.
+func (c *testClient) replies(action uint8, data any) []Message {
+	c.t.Helper()
+	c.send(action, data)
+	c.send(GetMySettingsAction, nil)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	replies := []Message{}
+	for {
+		_, text, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		// writePump sends queued messages in one frame, one per line
+		for _, line := range strings.Split(string(text), "\n") {
+			message := Message{}
+			if err := json.Unmarshal([]byte(line), &message); err != nil {
+				c.t.Fatal(err)
+			}
+			if message.Action == GetMySettingsAction {
+				return replies
+			}
+			replies = append(replies, message)
+		}
+	}
+}
+
+func TestClientActionUnsafeKeys(t *testing.T) {
+	testDbInit(t, "file")
+	c := testConnect(t, testHub())
+	developers = map[string][]byte{c.userId: []byte("{}")}
+	t.Cleanup(func() { developers = nil })
+	rec := testRecordKeys(t)
+
+	total, limit := 10, 10
+	var start int64 = 0
+	actions := []struct {
+		name   string
+		action uint8
+		data   func(key string) any
+	}{
+		{"GetChatMessages.ChatId", GetChatMessagesAction, func(key string) any {
+			return GetChatMessages{ChatId: key, Total: &total}
+		}},
+		{"GetChatMessages.ChatId with start", GetChatMessagesAction, func(key string) any {
+			return GetChatMessages{ChatId: key, Start: &start, Total: &total}
+		}},
+		{"GetChatMessages.ChatId with limit", GetChatMessagesAction, func(key string) any {
+			return GetChatMessages{ChatId: key, Limit: &limit}
+		}},
+		{"EditChatMessage.ChatId", EditChatMessageAction, func(key string) any {
+			return EditChatMessage{ChatId: key, Data: ChatMessage{Content: "edit", EditForTimestamp: 1}}
+		}},
+		{"NewChatMessage.ChatId", NewChatMessageAction, func(key string) any {
+			return NewChatMessage{ChatId: key, Data: ChatMessage{Content: "hello"}}
+		}},
+		{"RevokeSession.Id", RevokeSessionAction, func(key string) any {
+			return RevokeSession{Id: key}
+		}},
+		{"ResetPassword.UserId", ResetPasswordAction, func(key string) any {
+			return ResetPassword{UserId: key}
+		}},
+		{"ResetTotp.UserId", ResetTotpAction, func(key string) any {
+			return ResetTotp{UserId: key}
+		}},
+		{"RevokeInvite.Id", RevokeInviteAction, func(key string) any {
+			return RevokeInvite{Id: key}
+		}},
+	}
+	for _, a := range actions {
+		for _, key := range testUnsafeKeys {
+			replies := c.replies(a.action, a.data(key))
+			for _, reply := range replies {
+				if strings.Contains(string(reply.Data), "SENTINEL") {
+					t.Errorf("%s %q: reply contains data outside the table: %s", a.name, key, reply.Data)
+				}
+				if a.action != GetChatMessagesAction {
+					t.Errorf("%s %q: unexpected reply %s", a.name, key, reply.Data)
+				}
+			}
+		}
+	}
+	rec.check(t)
+
+	// Nothing was written through the unsafe keys
+	if text, _ := dbRead("settings", "victim"); string(text) != `{"secret":"SENTINEL"}` {
+		t.Errorf("settings/victim changed: %s", text)
+	}
+}
+
+func TestWsRejectsBadSessionToken(t *testing.T) {
+	testDbInit(t, "memory")
+	url := testServer(t, testHub())
+
+	// In the Authorization header, before the upgrade
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"not a session token"}})
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Dial with a bad token = %v, %v, want status 401", resp, err)
+	}
+
+	// In the first message
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(IncomingMessage{SessionToken: "not a session token"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("read after a bad hello = %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+}
+
+// testWsClosed checks that the server closes conn without sending it anything.
+func testWsClosed(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, text, err := conn.ReadMessage()
+	if err == nil {
+		t.Fatalf("unauthenticated socket received %s", text)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("server didn't close the unauthenticated socket")
+	}
+}
+
+func TestWsHelloTimeout(t *testing.T) {
+	testDbInit(t, "memory")
+	hub := testHub()
+	hub.helloWait = 100 * time.Millisecond
+	url := testServer(t, hub)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	testWsClosed(t, conn)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("socket closed after %v, before helloWait", elapsed)
+	}
+}
+
+func TestWsUnauthenticatedBroadcast(t *testing.T) {
+	testDbInit(t, "memory")
+	hub := testHub()
+	hub.helloWait = 500 * time.Millisecond
+	c := testConnect(t, hub)
+	url := testServer(t, hub)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	message := Message{UserId: "other", Action: NewChatMessageAction, Data: json.RawMessage(`{"content":"broadcast"}`)}
+	messageText, _ := json.Marshal(message)
+	hub.broadcast <- messageText
+
+	// The broadcast reaches the authenticated socket
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for received := false; !received; {
+		_, text, err := c.conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(text), "\n") {
+			received = received || line == string(messageText)
+		}
+	}
+	testWsClosed(t, conn)
+}
+
+// testUsername returns a user's username.
+func testUsername(t *testing.T, userId string) string {
+	t.Helper()
+	userText, _ := dbRead("user", userId)
+	user := User{}
+	if json.Unmarshal(userText, &user) != nil {
+		t.Fatalf("invalid user %s", userId)
+	}
+	return user.Username
+}
+
+// TestChangeUsernameRace has two users claim the same username at once and
+// checks that only one of them gets it.
+func TestChangeUsernameRace(t *testing.T) {
+	testDbInit(t, "memory")
+	hub := testHub()
+	clients := []*testClient{testConnect(t, hub), testConnect(t, hub)}
+	for round := 0; round < 20; round++ {
+		username := fmt.Sprintf("taken%d", round)
+		old := []string{testUsername(t, clients[0].userId), testUsername(t, clients[1].userId)}
+		for _, c := range clients {
+			c.send(ChangeUsernameAction, ChangeUsername{Username: username})
+		}
+		// Wait for both requests to be handled
+		for _, c := range clients {
+			c.replies(0, nil)
+		}
+
+		owner, _ := dbRead("username_to_user_id", username)
+		winners := 0
+		for i, c := range clients {
+			switch testUsername(t, c.userId) {
+			case username:
+				winners++
+				if string(owner) != c.userId {
+					t.Errorf("round %d: %s is indexed to %s, not its owner %s", round, username, owner, c.userId)
+				}
+				if dbExists("username_to_user_id", old[i]) {
+					t.Errorf("round %d: winning user's old username is still indexed", round)
+				}
+			case old[i]:
+				if value, _ := dbRead("username_to_user_id", old[i]); string(value) != c.userId {
+					t.Errorf("round %d: losing user lost their old username", round)
+				}
+			default:
+				t.Errorf("round %d: user has username %q", round, testUsername(t, c.userId))
+			}
+		}
+		if winners != 1 {
+			t.Fatalf("round %d: %d users got the username", round, winners)
+		}
+	}
+}
+
+// testDial opens another websocket to a test server with a session token.
+func testDial(t *testing.T, url, sessionToken string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {sessionToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testWsRevoked checks that the server closes conn because its session was
+// revoked.
+func testWsRevoked(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		// Broadcasts may arrive before the connection is closed
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("connection ended with %v, want it closed for the revoked session", err)
+		}
+		return
+	}
+}
+
+// testWsAlive checks that conn is still served.
+func testWsAlive(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	if err := conn.WriteJSON(Message{Action: GetMySettingsAction}); err != nil {
+		t.Fatalf("connection was closed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, text, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("connection was closed: %v", err)
+		}
+		for _, line := range strings.Split(string(text), "\n") {
+			message := Message{}
+			if json.Unmarshal([]byte(line), &message) == nil && message.Action == GetMySettingsAction {
+				return
+			}
+		}
+	}
+}
+
+// TestLogoutClosesSessionSockets logs out with LogoutAction and /logout and
+// checks that every socket of the session is closed, while sockets of the
+// user's other sessions stay open.
+func TestLogoutClosesSessionSockets(t *testing.T) {
+	testDbInit(t, "memory")
+	hub := testHub()
+	c := testConnect(t, hub)
+	url := testServer(t, hub)
+	newSession := func() string {
+		sessionToken, ok := sessions.Create(c.userId, "test", "127.0.0.1")
+		if !ok {
+			t.Fatal("sessions.Create failed")
+		}
+		return sessionToken
+	}
+	other := testDial(t, url, newSession())
+
+	// LogoutAction from one of the session's sockets
+	second := testDial(t, url, c.sessionToken)
+	testWsAlive(t, second)
+	c.send(LogoutAction, nil)
+	testWsRevoked(t, c.conn)
+	testWsRevoked(t, second)
+	testWsAlive(t, other)
+
+	// /logout
+	sessionToken := newSession()
+	sockets := []*websocket.Conn{testDial(t, url, sessionToken), testDial(t, url, sessionToken)}
+	for _, conn := range sockets {
+		testWsAlive(t, conn)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.Header.Set("Authorization", sessionToken)
+	w := httptest.NewRecorder()
+	serveHome(hub, w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("/logout = %d", w.Code)
+	}
+	for _, conn := range sockets {
+		testWsRevoked(t, conn)
+	}
+	testWsAlive(t, other)
+}
@@ -1,129 +1,229 @@
 package main
 
 import (
-	"bufio"
-	"io"
-	"io/fs"
 	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-var dbPerm fs.FileMode = 0700
+// db is the storage backend selected by DB_BACKEND at startup.
+var db Store
+
+// dbCache is the cache in front of the storage backend, if enabled.
+var dbCache *cacheStore
+
+// dbCrypt encrypts values before they reach the storage backend, if an
+// encryption key is configured.
+var dbCrypt *cryptStore
+
+// dbRaw is the storage backend itself, which holds values as they are stored.
+var dbRaw Store
+
+var dbTables = []string{
+	"message",
+	"token_to_user_id",
+	"oidc_to_user_id",
+	"username_to_user_id",
+	"user",
+	"chat_messages",
+	"chat_index",
+	"chat_manifest",
+	"chat_archive",
+	"chat_linemap",
+	"chat_edits",
+	"chat_retention",
+	"image",
+	"settings",
+	"session",
+	"registration",
+	"invite",
+	"password",
+	"totp",
+	"developer",
+	"meta",
+}
+
+// Every write through the db* functions holds dbWriteLock shared. Taking it
+// exclusively stops all writes, which lets backups read a consistent copy of
+// every table while the server keeps serving reads.
+var dbWriteLock sync.RWMutex
+
+// Tables whose values are append-only logs with one JSON object per line
+var dbLogTables = []string{
+	"chat_messages",
+	"chat_edits",
+}
+
+func dbIsLogTable(table string) bool {
+	for _, t := range dbLogTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
 
 func dbInit() {
-	os.MkdirAll(DataDir, dbPerm)
-	os.Mkdir(DataDir+"/message", dbPerm)
-	os.Mkdir(DataDir+"/token_to_user_id", dbPerm)
-	os.Mkdir(DataDir+"/username_to_user_id", dbPerm)
-	os.Mkdir(DataDir+"/user", dbPerm)
-	os.Mkdir(DataDir+"/chat_messages", dbPerm)
-	os.Mkdir(DataDir+"/image", dbPerm)
-	os.Mkdir(DataDir+"/settings", dbPerm)
-	os.Mkdir(DataDir+"/developer", dbPerm)
+	dbOpen(false)
+}
+
+// dbInitReadOnly opens the store like dbInit, but only for reading, see
+// openStoreReadOnly.
+func dbInitReadOnly() {
+	dbOpen(true)
+}
+
+func dbOpen(readOnly bool) {
+	var store Store
+	var err error
+	if readOnly {
+		store, err = openStoreReadOnly(DbBackend, DataDir)
+	} else {
+		store, err = openStore(DbBackend, DataDir)
+	}
+	if err != nil {
+		myslog.Error("dbInit", "err", err)
+		os.Exit(1)
+	}
+	dbRaw = store
+	keyring, err := cryptLoadKeyring()
+	if err != nil {
+		myslog.Error("dbInit", "err", err)
+		os.Exit(1)
+	}
+	if keyring != nil {
+		dbCrypt = newCryptStore(store, keyring)
+		store = dbCrypt
+	}
+	// Init creates directories and recovers torn logs, which must not happen
+	// to a read-only store
+	if !readOnly {
+		if err := store.Init(dbTables); err != nil {
+			myslog.Error("dbInit", "backend", DbBackend, "err", err)
+			os.Exit(1)
+		}
+	}
+	if DbCache && DbBackend != "memory" {
+		dbCache = newCacheStore(store, dbCachedTables)
+		store = dbCache
+	}
+	db = store
 }
 
-func dbTablePath(table string) string {
-	return DataDir + "/" + table
+// Maximum key length. Most filesystems limit file names to 255 bytes.
+const dbMaxKeyLength = 255
+
+// dbValidKey reports whether key is safe to use as a key in any backend. Keys
+// often come straight from clients (chat ids, usernames, image names), so
+// anything that could be interpreted as a path outside of its table is
+// rejected. Every db* function that takes a key checks it with dbCheckKey.
+func dbValidKey(key string) bool {
+	if key == "" || key == "." || key == ".." || len(key) > dbMaxKeyLength {
+		return false
+	}
+	if !utf8.ValidString(key) {
+		return false
+	}
+	return !strings.ContainsAny(key, "/\\\x00")
 }
 
-func dbPath(table, key string) string {
-	return dbTablePath(table) + "/" + key
+func dbCheckKey(table, key string) bool {
+	if !dbValidKey(key) {
+		myslog.Warn("rejected unsafe key", "table", table, "key", key)
+		return false
+	}
+	return true
 }
 
 func dbRead(table, key string) (value []byte, ok bool) {
-	value, err := os.ReadFile(dbPath(table, key))
-	return value, err == nil
+	if !dbCheckKey(table, key) {
+		return nil, false
+	}
+	return db.Read(table, key)
 }
 
 func dbExists(table, key string) bool {
-	_, err := os.Stat(dbPath(table, key))
-	return err == nil
+	if !dbCheckKey(table, key) {
+		return false
+	}
+	return db.Exists(table, key)
 }
 
 func dbReadAll(table string) (values map[string]([]byte), ok bool) {
-	files, err := os.ReadDir(dbTablePath(table))
-	if err != nil {
-		return nil, false
-	}
+	return db.ReadAll(table)
+}
 
-	values = map[string]([]byte){}
+func dbKeys(table string) (keys []string, ok bool) {
+	return db.Keys(table)
+}
 
-	for _, file := range files {
-		values[file.Name()], ok = dbRead(table, file.Name())
-		if !ok {
-			return nil, false
-		}
+func dbSize(table, key string) (size int64, ok bool) {
+	if !dbCheckKey(table, key) {
+		return 0, false
 	}
+	return db.Size(table, key)
+}
 
-	return values, true
+func dbReadRange(table, key string, offset int64, length int) (value []byte, ok bool) {
+	if !dbCheckKey(table, key) {
+		return nil, false
+	}
+	return db.ReadRange(table, key, offset, length)
 }
 
-// Constructs a valid JSON array from a portion of a file containing one JSON object per line
+// Constructs a valid JSON array from a portion of a value containing one JSON object per line
 func dbReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
-	file, err := os.OpenFile(dbPath(table, key), os.O_RDONLY, dbPerm)
-	if err != nil {
+	if !dbCheckKey(table, key) {
 		return nil, 0, 0, false
 	}
-	defer file.Close()
-
-	newOffset, err = file.Seek(int64(offset), whence)
+	return db.ReadEntries(table, key, offset, whence, total)
+}
 
-	// If the offset is invalid, just start at the beginning of the file.
-	skip := true
-	if err != nil {
-		newOffset, err = file.Seek(0, io.SeekStart)
-		// We don't need to skip the first line since it will be valid JSON
-		skip = false
-		if err != nil {
-			return nil, 0, 0, false
-		}
+func dbWrite(table, key string, value []byte) bool {
+	if !dbCheckKey(table, key) {
+		return false
 	}
+	dbWriteLock.RLock()
+	defer dbWriteLock.RUnlock()
+	return db.Write(table, key, value)
+}
 
-	scanner := bufio.NewScanner(file)
-	// Allocate enough space for JSON objects with '[' and ']' characters
-	data := make([]byte, total+2)
-	data[0] = '[' // Open bracket for new JSON array
-	i := 1
-	for scanner.Scan() {
-		// Skip first line since it is probably invalid JSON (we most likely seeked into the middle of a line)
-		if skip {
-			skip = false
-			continue
-		}
-		if i >= total {
-			i = total
-			break
-		}
-		bytes := scanner.Bytes()
-		end := i + len(bytes)
-		if end > total {
-			break
-		}
-		if len(bytes) > 0 {
-			copy(data[i:end], bytes)
-			data[end] = ',' // Insert commas to construct array
-		}
-		i = end + 1
+// dbUpdate atomically replaces the value of a key with the result of fn. See Store.Update.
+func dbUpdate(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	if !dbCheckKey(table, key) {
+		return false
 	}
-	data[i-1] = ']' // Replace very last comma to finish closing array
-	return data[0:i], newOffset, i - 1, true
+	dbWriteLock.RLock()
+	defer dbWriteLock.RUnlock()
+	return db.Update(table, key, fn)
 }
 
-func dbWrite(table, key string, value []byte) bool {
-	return os.WriteFile(dbPath(table, key), value, dbPerm) == nil
+// dbCreate writes a value only if the key does not exist yet.
+func dbCreate(table, key string, value []byte) bool {
+	if !dbCheckKey(table, key) {
+		return false
+	}
+	dbWriteLock.RLock()
+	defer dbWriteLock.RUnlock()
+	return db.Create(table, key, value)
 }
 
 func dbAppend(table, key string, value []byte) bool {
-	file, err := os.OpenFile(dbPath(table, key), os.O_APPEND|os.O_CREATE|os.O_WRONLY, dbPerm)
-	if err != nil {
-		return false
-	}
-	defer file.Close()
-	if _, err := file.Write(value); err != nil {
+	if !dbCheckKey(table, key) {
 		return false
 	}
-	return true
+	dbWriteLock.RLock()
+	defer dbWriteLock.RUnlock()
+	return db.Append(table, key, value)
 }
 
-func dbDelete(table, key string) {
-	os.Remove(dbPath(table, key))
+// dbDelete deletes a key and reports whether it existed.
+func dbDelete(table, key string) bool {
+	if !dbCheckKey(table, key) {
+		return false
+	}
+	dbWriteLock.RLock()
+	defer dbWriteLock.RUnlock()
+	return db.Delete(table, key)
 }
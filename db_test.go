@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// Keys that must never reach a store: they could name a file outside of their
+// table with the file backend.
+var testUnsafeKeys = []string{
+	"",
+	".",
+	"..",
+	"../settings/victim",
+	"../user/victim",
+	"a/b",
+	`a\b`,
+	"a\x00b",
+	strings.Repeat("a", 256),
+	"\xff\xfe",
+}
+
+func TestDbValidKey(t *testing.T) {
+	for _, key := range testUnsafeKeys {
+		if dbValidKey(key) {
+			t.Errorf("dbValidKey(%q) = true", key)
+		}
+	}
+	for _, key := range []string{"global", "a.b", "user..name", "...", strings.Repeat("a", 255), "image.png", "ünïcode"} {
+		if !dbValidKey(key) {
+			t.Errorf("dbValidKey(%q) = false", key)
+		}
+	}
+}
+
+// recordStore records the keys of every call that reaches the store.
+type recordStore struct {
+	Store
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *recordStore) record(table, key string) {
+	s.mu.Lock()
+	s.keys = append(s.keys, table+"/"+key)
+	s.mu.Unlock()
+}
+
+func (s *recordStore) Read(table, key string) ([]byte, bool) {
+	s.record(table, key)
+	return s.Store.Read(table, key)
+}
+
+func (s *recordStore) Write(table, key string, value []byte) bool {
+	s.record(table, key)
+	return s.Store.Write(table, key, value)
+}
+
+func (s *recordStore) Exists(table, key string) bool {
+	s.record(table, key)
+	return s.Store.Exists(table, key)
+}
+
+func (s *recordStore) Append(table, key string, value []byte) bool {
+	s.record(table, key)
+	return s.Store.Append(table, key, value)
+}
+
+func (s *recordStore) Delete(table, key string) bool {
+	s.record(table, key)
+	return s.Store.Delete(table, key)
+}
+
+func (s *recordStore) Update(table, key string, fn func([]byte, bool) ([]byte, bool)) bool {
+	s.record(table, key)
+	return s.Store.Update(table, key, fn)
+}
+
+func (s *recordStore) Create(table, key string, value []byte) bool {
+	s.record(table, key)
+	return s.Store.Create(table, key, value)
+}
+
+func (s *recordStore) Size(table, key string) (int64, bool) {
+	s.record(table, key)
+	return s.Store.Size(table, key)
+}
+
+func (s *recordStore) ReadRange(table, key string, offset int64, length int) ([]byte, bool) {
+	s.record(table, key)
+	return s.Store.ReadRange(table, key, offset, length)
+}
+
+func (s *recordStore) ReadEntries(table, key string, offset int64, whence int, total int) ([]byte, int64, int, bool) {
+	s.record(table, key)
+	return s.Store.ReadEntries(table, key, offset, whence, total)
+}
+
+// testRecordKeys wraps the store in a recordStore and seeds values that the
+// unsafe keys point at, so that reading them would show up in responses.
+func testRecordKeys(t *testing.T) *recordStore {
+	t.Helper()
+	dbWrite("settings", "victim", []byte(`{"secret":"SENTINEL"}`))
+	dbWrite("user", "victim", []byte(`{"username":"SENTINEL"}`))
+	rec := &recordStore{Store: db}
+	db = rec
+	return rec
+}
+
+// check fails if an unsafe key reached the store. It doesn't use dbValidKey,
+// which is what's being tested.
+func (s *recordStore) check(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tableKey := range s.keys {
+		_, key, _ := strings.Cut(tableKey, "/")
+		if key == "" || key == "." || key == ".." || len(key) > 255 || strings.ContainsAny(key, "/\\\x00") || !utf8.ValidString(key) {
+			t.Errorf("unsafe key reached the store: %q", tableKey)
+		}
+	}
+}
+
+func TestImageUnsafeKeys(t *testing.T) {
+	testDbInit(t, "file")
+	rec := testRecordKeys(t)
+	for _, key := range testUnsafeKeys {
+		if strings.Contains(key, "/") || key == "" {
+			// Not a single path segment, so it can't be an image name
+			continue
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/image/x", nil)
+		r.URL.Path = "/image/" + key
+		r.URL.RawPath = "/image/" + url.PathEscape(key)
+		serveHome(nil, w, r)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "SENTINEL") {
+			t.Errorf("GET /image/%q: %d %q", key, w.Code, w.Body.String())
+		}
+	}
+	rec.check(t)
+}
+
+func TestLoginWithPasswordUnsafeKeys(t *testing.T) {
+	testDbInit(t, "file")
+	// A password for the user that ../user/victim would point at
+	dbWrite("password", "victim", []byte(`{"hash":"`+hashPassword("password")+`"}`))
+	dbWrite("username_to_user_id", "victim", []byte("victim"))
+	rec := testRecordKeys(t)
+	for _, key := range testUnsafeKeys {
+		if userId, ok := loginWithPassword(key, "password", "127.0.0.1"); ok {
+			t.Errorf("loginWithPassword(%q) logged in as %q", key, userId)
+		}
+		if userId, ok := loginWithPassword("../username_to_user_id/"+key, "password", "127.0.0.1"); ok {
+			t.Errorf("loginWithPassword(%q) logged in as %q", key, userId)
+		}
+	}
+	rec.check(t)
+}
@@ -1,6 +1,11 @@
 package main
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -9,5 +14,142 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int64) int64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+		myslog.Warn("invalid integer in environment, using default", "key", key, "value", value)
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		myslog.Warn("invalid boolean in environment, using default", "key", key, "value", value)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		myslog.Warn("invalid duration in environment, using default", "key", key, "value", value)
+	}
+	return fallback
+}
+
+// rate is a rate limit of n requests every per.
+type rate struct {
+	n   int64
+	per time.Duration
+}
+
+// getEnvRate parses a rate limit written as n/duration, e.g. 10/1h, or 0 for
+// no limit.
+func getEnvRate(key string, fallback rate) rate {
+	if value, ok := os.LookupEnv(key); ok {
+		if value == "0" {
+			return rate{}
+		}
+		n, per, _ := strings.Cut(value, "/")
+		r := rate{}
+		var err error
+		if r.n, err = strconv.ParseInt(n, 10, 64); err == nil && r.n > 0 {
+			if r.per, err = time.ParseDuration(per); err == nil && r.per > 0 {
+				return r
+			}
+		}
+		myslog.Warn("invalid rate limit in environment, using default", "key", key, "value", value)
+	}
+	return fallback
+}
+
 var cwd, _ = os.Getwd()
 var DataDir = getEnv("DATA_DIR", cwd+"/data")
+
+// Storage backend: "file" (one file per key under DATA_DIR), "bolt" (a single
+// database file at DATA_DIR/harmon.db) or "memory"
+var DbBackend = getEnv("DB_BACKEND", "file")
+
+// Durability of the file backend: "off" (atomic rename only), "normal" (also
+// fsync each written file) or "full" (also fsync directories and every append)
+var DbSync = getEnv("DB_SYNC", "normal")
+
+// A chat log segment is sealed and a new one started once it reaches this
+// size in bytes, or this age if it is not 0
+var ChatSegmentSize = getEnvInt("CHAT_SEGMENT_SIZE", 16<<20)
+var ChatSegmentAge = getEnvDuration("CHAT_SEGMENT_AGE", 0)
+
+// Whether sealed chat log segments are compressed into chat_archive
+var ChatCompressSegments = getEnvBool("CHAT_COMPRESS_SEGMENTS", false)
+
+// How often sealed chat log segments are compacted, or 0 to only compact with
+// the compact command
+var ChatCompactInterval = getEnvDuration("CHAT_COMPACT_INTERVAL", 0)
+
+// Default retention limits of every chat, which can be overridden per chat
+// with the retention command, and how often they are applied
+var ChatRetentionAge = getEnvDuration("CHAT_RETENTION_AGE", 0)
+var ChatRetentionCount = getEnvInt("CHAT_RETENTION_COUNT", 0)
+var ChatRetentionInterval = getEnvDuration("CHAT_RETENTION_INTERVAL", time.Hour)
+
+// Whether small, frequently read tables are cached in memory, and how often
+// cache hit/miss counts are logged
+var DbCache = getEnvBool("DB_CACHE", true)
+var DbCacheStatsInterval = getEnvDuration("DB_CACHE_STATS_INTERVAL", 10*time.Minute)
+
+// Keys that stored values are encrypted with, if set. See cryptLoadKeyring.
+var DbEncryptionKey = getEnv("DB_ENCRYPTION_KEY", "")
+var DbEncryptionKeyFile = getEnv("DB_ENCRYPTION_KEY_FILE", "")
+
+// How long a token from /register can be used to log in, or 0 for no limit,
+// and how many unused tokens there can be at once, or 0 for no limit
+var RegistrationTTL = getEnvDuration("REGISTRATION_TTL", 24*time.Hour)
+var RegistrationMaxPending = getEnvInt("REGISTRATION_MAX_PENDING", 10000)
+
+// Whether /register needs an invite code. See invite.go.
+var RegistrationInviteOnly = getEnvBool("REGISTRATION_INVITE_ONLY", false)
+
+// How long a session lasts without being used and in total, or 0 for no
+// limit, and how often expired sessions and registration tokens are deleted
+var SessionIdleTimeout = getEnvDuration("SESSION_IDLE_TIMEOUT", 30*24*time.Hour)
+var SessionMaxAge = getEnvDuration("SESSION_MAX_AGE", 0)
+var SessionSweepInterval = getEnvDuration("SESSION_SWEEP_INTERVAL", time.Hour)
+
+// Secret mixed into the hashes that login tokens are stored under. Changing
+// it makes every login token invalid.
+var LoginTokenPepper = getEnv("LOGIN_TOKEN_PEPPER", "")
+
+// OpenID Connect provider that users can log in with, if set. See oidc.go.
+var OidcIssuer = getEnv("OIDC_ISSUER", "")
+var OidcClientId = getEnv("OIDC_CLIENT_ID", "")
+var OidcClientSecret = getEnv("OIDC_CLIENT_SECRET", "")
+var OidcScopes = getEnv("OIDC_SCOPES", "openid profile")
+
+// This server's /oidc/callback as registered with the provider, and where the
+// browser is sent with the session token once it's logged in
+var OidcRedirectUrl = getEnv("OIDC_REDIRECT_URL", "")
+var OidcReturnUrl = getEnv("OIDC_RETURN_URL", "")
+
+// Rate limits per client IP address of /register, /login and POST /image, of
+// failed logins per account and of POST /image per user. See ratelimit.go.
+var RateLimitRegisterIp = getEnvRate("RATE_LIMIT_REGISTER_IP", rate{10, time.Hour})
+var RateLimitLoginIp = getEnvRate("RATE_LIMIT_LOGIN_IP", rate{20, time.Minute})
+var RateLimitLoginUser = getEnvRate("RATE_LIMIT_LOGIN_USER", rate{10, 10 * time.Minute})
+var RateLimitImageIp = getEnvRate("RATE_LIMIT_IMAGE_IP", rate{60, time.Minute})
+var RateLimitImageUser = getEnvRate("RATE_LIMIT_IMAGE_USER", rate{30, time.Minute})
+
+// Largest image that can be uploaded, in bytes
+var ImageMaxSize = getEnvInt("IMAGE_MAX_SIZE", 10<<20)
+
+// Whether requests come through a reverse proxy that sets X-Forwarded-For
+var TrustProxy = getEnvBool("TRUST_PROXY", false)
+
+// How many reverse proxies in front of the server append to X-Forwarded-For
+var TrustProxyHops = getEnvInt("TRUST_PROXY_HOPS", 1)
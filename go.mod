@@ -5,6 +5,11 @@ go 1.21.9
 require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.23.0
 )
 
-require golang.org/x/net v0.25.0 // indirect
+require (
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+)
@@ -4,6 +4,8 @@
 
 package main
 
+import "time"
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -18,6 +20,13 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Ids of revoked sessions whose clients should be disconnected.
+	revoke chan string
+
+	// Time allowed for clients that weren't authenticated during the
+	// handshake to send their first message.
+	helloWait time.Duration
 }
 
 func newHub() *Hub {
@@ -25,7 +34,9 @@ func newHub() *Hub {
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		revoke:     make(chan string),
 		clients:    make(map[*Client]bool),
+		helloWait:  helloWait,
 	}
 }
 
@@ -39,6 +50,12 @@ func (h *Hub) run() {
 				delete(h.clients, client)
 				close(client.send)
 			}
+		case sessionId := <-h.revoke:
+			for client := range h.clients {
+				if client.sessionId == sessionId {
+					go client.disconnect("session revoked")
+				}
+			}
 		case message := <-h.broadcast:
 			for client := range h.clients {
 				select {
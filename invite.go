@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Invite codes let developers and admins control who can register. With
+// REGISTRATION_INVITE_ONLY set, /register needs one. Every time a code is used
+// for /register, the user it creates is recorded so that it's known who
+// invited whom. Invites are kept in the invite table, keyed by a hash of the
+// code, which doubles as the invite's id.
+type Invite struct {
+	// The developer who created the invite, or empty if it was created with
+	// the invite command
+	CreatedBy string `json:"createdBy"`
+	Created   int64  `json:"created"`
+	// When the invite expires, or 0 if it doesn't
+	Expires int64 `json:"expires"`
+	// How many times the invite can be used, or 0 for no limit
+	MaxUses int `json:"maxUses"`
+	Uses    int `json:"uses"`
+	// The users who registered with the invite
+	Users   []string `json:"users"`
+	Revoked bool     `json:"revoked"`
+}
+
+func (i Invite) usable(now time.Time) bool {
+	if i.Revoked || (i.MaxUses > 0 && i.Uses >= i.MaxUses) {
+		return false
+	}
+	return i.Expires == 0 || now.UnixMilli() < i.Expires
+}
+
+// inviteStore holds the invites in the invite table. It is safe for
+// concurrent use: invites are only changed with Update.
+type inviteStore struct {
+	table string
+}
+
+var invites = &inviteStore{table: "invite"}
+
+// Create makes a new invite that expires after expiresIn, or never if it is 0,
+// and returns the invite, its code and its id.
+func (s *inviteStore) Create(createdBy string, maxUses int, expiresIn time.Duration) (invite Invite, code, id string, ok bool) {
+	if maxUses < 0 || expiresIn < 0 {
+		return invite, "", "", false
+	}
+	now := time.Now()
+	invite = Invite{CreatedBy: createdBy, Created: now.UnixMilli(), MaxUses: maxUses, Users: []string{}}
+	if expiresIn > 0 {
+		invite.Expires = now.Add(expiresIn).UnixMilli()
+	}
+	text, _ := json.Marshal(invite)
+	for i := 0; i < 10; i++ {
+		code = randomString(24)
+		id = hashToken(code)
+		if dbCreate(s.table, id, text) {
+			return invite, code, id, true
+		}
+	}
+	return invite, "", "", false
+}
+
+// update changes an invite with fn, which returns false to leave it unchanged.
+func (s *inviteStore) update(id string, fn func(invite *Invite) bool) bool {
+	return dbUpdate(s.table, id, func(text []byte, ok bool) ([]byte, bool) {
+		invite := Invite{}
+		if !ok || json.Unmarshal(text, &invite) != nil || !fn(&invite) {
+			return nil, false
+		}
+		text, _ = json.Marshal(invite)
+		return text, true
+	})
+}
+
+// Use counts a use of an invite code and returns the invite's id. It fails if
+// the invite doesn't exist or can't be used anymore.
+func (s *inviteStore) Use(code string) (id string, ok bool) {
+	id = hashToken(code)
+	return id, s.update(id, func(invite *Invite) bool {
+		if !invite.usable(time.Now()) {
+			return false
+		}
+		invite.Uses++
+		return true
+	})
+}
+
+// Release takes back a use of an invite whose registration failed.
+func (s *inviteStore) Release(id string) {
+	s.update(id, func(invite *Invite) bool {
+		invite.Uses = max(invite.Uses-1, 0)
+		return true
+	})
+}
+
+// Attribute records that a user registered with an invite.
+func (s *inviteStore) Attribute(id, userId string) {
+	s.update(id, func(invite *Invite) bool {
+		invite.Users = append(invite.Users, userId)
+		return true
+	})
+}
+
+// Revoke stops an invite from being used. The invite is kept so that the
+// users who registered with it are still known.
+func (s *inviteStore) Revoke(id string) bool {
+	return s.update(id, func(invite *Invite) bool {
+		invite.Revoked = true
+		return true
+	})
+}
+
+// List returns every invite, newest first.
+func (s *inviteStore) List() []InviteInfo {
+	values, _ := dbReadAll(s.table)
+	list := []InviteInfo{}
+	for id, text := range values {
+		info := InviteInfo{Id: id}
+		if json.Unmarshal(text, &info.Invite) != nil {
+			continue
+		}
+		if info.Users == nil {
+			info.Users = []string{}
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	return list
+}
+
+// inviteCommand runs the invite command: "create" makes a new invite and
+// prints its code, "list" prints every invite and "revoke <id>" revokes one.
+func inviteCommand(args []string) bool {
+	if len(args) == 0 {
+		myslog.Error("usage: invite [create [-max-uses n] [-expires duration] | list | revoke <id>]")
+		return false
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("invite create", flag.ExitOnError)
+		maxUses := flags.Int("max-uses", 1, "how many users can register with the invite, or 0 for no limit")
+		expiresIn := flags.Duration("expires", 7*24*time.Hour, "how long the invite can be used for, or 0 for no limit")
+		if flags.Parse(args[1:]) != nil || flags.NArg() != 0 || *maxUses < 0 || *expiresIn < 0 {
+			myslog.Error("usage: invite create [-max-uses n] [-expires duration]")
+			return false
+		}
+		invite, code, id, ok := invites.Create("", *maxUses, *expiresIn)
+		if !ok {
+			return false
+		}
+		myslog.Info("invite created", "id", id, "maxUses", invite.MaxUses, "expires", invite.Expires)
+		fmt.Println(code)
+	case "list":
+		for _, info := range invites.List() {
+			text, _ := json.Marshal(info)
+			fmt.Println(string(text))
+		}
+	case "revoke":
+		if len(args) != 2 || !dbValidKey(args[1]) {
+			myslog.Error("usage: invite revoke <id>")
+			return false
+		}
+		if !invites.Revoke(args[1]) {
+			myslog.Error("no such invite", "id", args[1])
+			return false
+		}
+		myslog.Info("invite revoked", "id", args[1])
+	default:
+		myslog.Error("unknown invite command", "command", args[0])
+		return false
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testInviteUses(t *testing.T, id string) int {
+	t.Helper()
+	text, ok := dbRead("invite", id)
+	invite := Invite{}
+	if !ok || json.Unmarshal(text, &invite) != nil {
+		t.Fatal("invite not found")
+	}
+	return invite.Uses
+}
+
+func TestInviteCreate(t *testing.T) {
+	testDbInit(t, "memory")
+	for _, test := range []struct {
+		maxUses   int
+		expiresIn time.Duration
+		ok        bool
+	}{
+		{1, time.Hour, true},
+		{0, 0, true},
+		{-1, time.Hour, false},
+		{1, -time.Millisecond, false},
+	} {
+		start := time.Now().UnixMilli()
+		invite, code, id, ok := invites.Create("", test.maxUses, test.expiresIn)
+		if ok != test.ok {
+			t.Errorf("Create(%d, %v) ok = %v, want %v", test.maxUses, test.expiresIn, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if id != hashToken(code) || !dbExists("invite", id) {
+			t.Errorf("Create(%d, %v) didn't save the invite", test.maxUses, test.expiresIn)
+		}
+		if test.expiresIn == 0 && invite.Expires != 0 {
+			t.Errorf("Create(%d, %v) expires at %d, want 0", test.maxUses, test.expiresIn, invite.Expires)
+		}
+		if test.expiresIn > 0 && (invite.Expires < start+test.expiresIn.Milliseconds() || invite.Expires > time.Now().Add(test.expiresIn).UnixMilli()) {
+			t.Errorf("Create(%d, %v) expires at %d, want %v from now", test.maxUses, test.expiresIn, invite.Expires, test.expiresIn)
+		}
+	}
+}
+
+func TestRegistrationReleasesInvite(t *testing.T) {
+	testDbInit(t, "memory")
+	defer func(ttl time.Duration) { RegistrationTTL = ttl }(RegistrationTTL)
+	RegistrationTTL = time.Millisecond
+	_, code, _, ok := invites.Create("", 2, 0)
+	if !ok {
+		t.Fatal("Create failed")
+	}
+
+	// Expired tokens give back their use when they are swept or used
+	id, _ := invites.Use(code)
+	registrations.Issue(id)
+	id, _ = invites.Use(code)
+	token, _ := registrations.Issue(id)
+	if _, ok := invites.Use(code); ok {
+		t.Fatal("used an invite more times than it allows")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := login(token); ok {
+		t.Error("logged in with an expired token")
+	}
+	if uses := testInviteUses(t, id); uses != 1 {
+		t.Errorf("invite has %d uses after an expired token was used, want 1", uses)
+	}
+	registrations.Sweep()
+	if uses := testInviteUses(t, id); uses != 0 {
+		t.Errorf("invite has %d uses after expired tokens were swept, want 0", uses)
+	}
+	if registrations.Pending() != 0 {
+		t.Errorf("%d tokens pending, want 0", registrations.Pending())
+	}
+
+	// Tokens that are used to log in keep their use
+	RegistrationTTL = time.Hour
+	id, _ = invites.Use(code)
+	token, _ = registrations.Issue(id)
+	if _, ok := login(token); !ok {
+		t.Fatal("login failed")
+	}
+	registrations.Sweep()
+	if uses := testInviteUses(t, id); uses != 1 {
+		t.Errorf("invite has %d uses after it was used to register, want 1", uses)
+	}
+}
+
+func TestCreateInviteAction(t *testing.T) {
+	testDbInit(t, "memory")
+	c := testConnect(t, testHub())
+	developers = map[string][]byte{c.userId: []byte("{}")}
+	t.Cleanup(func() { developers = nil })
+
+	start := time.Now().UnixMilli()
+	replies := c.replies(CreateInviteAction, CreateInvite{MaxUses: 1, ExpiresIn: time.Hour.Milliseconds()})
+	if len(replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(replies))
+	}
+	r := CreateInvite{}
+	json.Unmarshal(replies[0].Data, &r)
+	if r.Code == "" || r.Id != hashToken(r.Code) {
+		t.Errorf("reply has code %q and id %q", r.Code, r.Id)
+	}
+	if r.Expires < start+time.Hour.Milliseconds() || r.Expires > time.Now().Add(time.Hour).UnixMilli() {
+		t.Errorf("invite expires at %d, want an hour from now", r.Expires)
+	}
+
+	for _, r := range []CreateInvite{{MaxUses: 1, ExpiresIn: -1}, {MaxUses: -1}, {ExpiresIn: 1 << 62}} {
+		if replies := c.replies(CreateInviteAction, r); len(replies) != 0 {
+			t.Errorf("CreateInvite %+v got %d replies, want none", r, len(replies))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDataDir takes an exclusive lock on DATA_DIR/.lock, which the server
+// holds while it uses a data directory and restore holds while it replaces
+// one. The lock is released by unlock or when the process exits.
+func lockDataDir(dir string) (unlock func(), err error) {
+	file, err := os.OpenFile(dir+"/.lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errDataDirLocked
+		}
+		return nil, err
+	}
+	// The pid is only for people wondering who holds the lock
+	file.Truncate(0)
+	fmt.Fprintln(file, os.Getpid())
+	return func() { file.Close() }, nil
+}
@@ -6,20 +6,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// Either the login token or the username and password are required, and the
+// code from the authenticator app or a recovery code if the user has
+// two-factor authentication enabled
 type LoginRequestBody struct {
-	Token string `json:"token"`
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
 }
 
 type LoginResponseBody struct {
@@ -29,11 +38,54 @@ type LoginResponseBody struct {
 }
 
 var addr = flag.String("addr", ":8080", "http service address")
+var migrateDryRun = flag.Bool("migrate-dry-run", false, "log the schema migrations that would run and exit")
 
 var jsonHandler = slog.NewJSONHandler(os.Stdout, nil)
 var myslog = slog.New(jsonHandler)
 
-func serveHome(w http.ResponseWriter, r *http.Request) {
+// clientIP returns the IP address a request came from. With TRUST_PROXY set,
+// the address added to X-Forwarded-For by the outermost of TRUST_PROXY_HOPS
+// reverse proxies is used. Each proxy appends the address it got the request
+// from, so entries before that one come from the client and can be forged.
+func clientIP(r *http.Request) string {
+	if TrustProxy && TrustProxyHops > 0 {
+		forwarded := []string{}
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		if len(forwarded) > 0 {
+			i := max(len(forwarded)-int(TrustProxyHops), 0)
+			return strings.TrimSpace(forwarded[i])
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// loginResponse returns the body of a successful /login response.
+func loginResponse(userId, sessionToken string) ([]byte, bool) {
+	userText, ok := dbRead("user", userId)
+	if !ok {
+		return nil, false
+	}
+	user := User{}
+	if json.Unmarshal(userText, &user) != nil {
+		return nil, false
+	}
+	res := LoginResponseBody{
+		SessionToken: sessionToken,
+		UserId:       userId,
+	}
+	user.Presence = OnlinePresence
+	res.User, _ = json.Marshal(user)
+	resText, _ := json.Marshal(res)
+	return resText, true
+}
+
+func serveHome(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
 	if r.Method == http.MethodOptions {
@@ -47,39 +99,101 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if body.Token == "" {
+		var userId string
+		var ok bool
+		if body.Token != "" {
+			userId, ok = login(body.Token)
+		} else if body.Username != "" && body.Password != "" {
+			// Counted per address too, so that failing on purpose can't
+			// lock the owner of an account out of it
+			key := "username:" + body.Username + "@" + clientIP(r)
+			if !loginUserLimiter.check(w, r, key) {
+				return
+			}
+			if userId, ok = loginWithPassword(body.Username, body.Password, clientIP(r)); !ok {
+				loginUserLimiter.fail(key)
+			}
+		} else {
 			http.Error(w, "missing token", http.StatusBadRequest)
 			return
 		}
-
-		if sessionToken, ok := login(body.Token); ok {
-			if userId, ok := dbRead("token_to_user_id", body.Token); ok {
-				if userText, ok := dbRead("user", string(userId)); ok {
-					user := User{}
-					if json.Unmarshal(userText, &user) == nil {
-						res := LoginResponseBody{
-							SessionToken: sessionToken,
-							UserId:       string(userId),
-						}
-						user.Presence = OnlinePresence
-						res.User, _ = json.Marshal(user)
-						resText, _ := json.Marshal(res)
-						fmt.Fprintf(w, string(resText))
-						myslog.Info("login", "userId", res.UserId)
-						return
-					}
-				}
+		if ok && totpEnabled(userId) {
+			if body.Code == "" {
+				http.Error(w, "two-factor code required", http.StatusUnauthorized)
+				return
+			}
+			// Only the password is needed to get here, so codes are
+			// counted per account
+			key := "user:" + userId
+			if !loginUserLimiter.check(w, r, key) {
+				return
+			}
+			if !totpCheck(userId, body.Code) {
+				loginUserLimiter.fail(key)
+				myslog.Info("wrong two-factor code", "userId", userId, "ip", clientIP(r))
+				http.Error(w, "invalid two-factor code", http.StatusUnauthorized)
+				return
 			}
+		}
 
+		var sessionToken string
+		if ok {
+			sessionToken, ok = sessions.Create(userId, r.UserAgent(), clientIP(r))
+		}
+		if ok {
+			if resText, ok := loginResponse(userId, sessionToken); ok {
+				fmt.Fprintf(w, string(resText))
+				myslog.Info("login", "userId", userId)
+				return
+			}
 		}
 
 		http.Error(w, "login error", http.StatusInternalServerError)
 		return
 	}
+	if r.URL.Path == "/oidc/login" && r.Method == http.MethodGet {
+		oidc.serveLogin(w, r)
+		return
+	}
+	if r.URL.Path == "/oidc/callback" && r.Method == http.MethodGet {
+		oidc.serveCallback(w, r)
+		return
+	}
+	if r.URL.Path == "/logout" && r.Method == http.MethodPost {
+		userId, _ := getUserId(r.Header.Get("Authorization"))
+		sessionId, ok := sessions.Delete(r.Header.Get("Authorization"))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hub.revoke <- sessionId
+		w.WriteHeader(http.StatusNoContent)
+		myslog.Info("logout", "userId", userId)
+		return
+	}
 	if r.URL.Path == "/register" && r.Method == http.MethodGet {
-		token := register()
+		invite := ""
+		if code := r.URL.Query().Get("invite"); code != "" {
+			var ok bool
+			if invite, ok = invites.Use(code); !ok {
+				http.Error(w, "invalid invite code", http.StatusForbidden)
+				return
+			}
+		} else if RegistrationInviteOnly {
+			http.Error(w, "invite code required", http.StatusForbidden)
+			return
+		}
+		token, ok := registrations.Issue(invite)
+		if !ok {
+			if invite != "" {
+				invites.Release(invite)
+			}
+			http.Error(w, "too many pending registrations", http.StatusServiceUnavailable)
+			myslog.Warn("register failed", "pending", registrations.Pending())
+			return
+		}
 		fmt.Fprintf(w, `{"token":"`+token+`"}`)
-		myslog.Info("register", "token", token)
+		myslog.Info("register", "pending", registrations.Pending())
 		return
 	}
 	if strings.HasPrefix(r.URL.Path, "/image") {
@@ -99,9 +213,14 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 					fileExt = split[len(split)-1]
 				}
 				if sessionToken := r.Header.Get("Authorization"); sessionToken != "" {
-					if token := getToken(sessionToken); token != "" {
+					if _, ok := getUserId(sessionToken); ok {
 						imageId := uuid.NewString() + "." + fileExt
-						buf, err := io.ReadAll(r.Body)
+						buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ImageMaxSize))
+						if maxBytesError := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesError) {
+							http.Error(w, "image too large", http.StatusRequestEntityTooLarge)
+							myslog.Warn("image too large", "ip", clientIP(r), "maxSize", ImageMaxSize)
+							return
+						}
 						if err == nil && len(buf) > 0 {
 							dbWrite("image", imageId, buf)
 							fmt.Fprintf(w, string(imageId))
@@ -124,16 +243,169 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
+	if r.URL.Path == "/backup" && r.Method == http.MethodGet {
+		userId, ok := getUserId(r.Header.Get("Authorization"))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !isDeveloper(userId) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		serveBackup(w, userId)
+		return
+	}
 	http.Error(w, "Not found", http.StatusNotFound)
 	return
 }
 
+// serveBackup sends a backup of every table. The backup is written to a
+// temporary file first so that writes aren't blocked while it downloads.
+func serveBackup(w http.ResponseWriter, userId string) {
+	file, err := os.CreateTemp("", "harmon-backup-*.tar.gz")
+	if err != nil {
+		http.Error(w, "backup error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := dbBackup(file); err != nil {
+		myslog.Error("backup", "userId", userId, "err", err)
+		http.Error(w, "backup error", http.StatusInternalServerError)
+		return
+	}
+	size, _ := file.Seek(0, io.SeekCurrent)
+	file.Seek(0, io.SeekStart)
+	name := "harmon-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, file)
+	myslog.Info("backup", "userId", userId, "size", size)
+}
+
 func main() {
-	dbInit()
 	flag.Parse()
+	if flag.Arg(0) == "restore" {
+		if flag.NArg() != 2 {
+			myslog.Error("usage: restore <backup.tar.gz>")
+			os.Exit(2)
+		}
+		if err := dbRestoreFile(flag.Arg(1)); err != nil {
+			myslog.Error("restore", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *migrateDryRun {
+		dbInitReadOnly()
+		if err := dbMigrate(true); err != nil {
+			myslog.Error("migrate", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	dbInit()
+	if err := dbMigrate(false); err != nil {
+		myslog.Error("migrate", "err", err)
+		os.Exit(1)
+	}
+	chatIndexInit()
+
+	switch flag.Arg(0) {
+	case "":
+	case "compact":
+		chatCompactAll()
+		db.Close()
+		return
+	case "retention":
+		ok := chatRetentionCommand(flag.Args()[1:])
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case "password":
+		ok := passwordCommand(flag.Args()[1:])
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case "totp":
+		ok := totpCommand(flag.Args()[1:])
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case "invite":
+		ok := inviteCommand(flag.Args()[1:])
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	case "encrypt":
+		if dbCrypt == nil {
+			myslog.Error("encrypt: DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEY_FILE must be set")
+			os.Exit(2)
+		}
+		encrypted, rewrapped, err := dbCrypt.encryptAll(dbTables)
+		db.Close()
+		myslog.Info("encrypt", "encrypted", encrypted, "rewrapped", rewrapped)
+		if err != nil {
+			myslog.Error("encrypt", "err", err)
+			os.Exit(1)
+		}
+		return
+	case "check":
+		flags := flag.NewFlagSet("check", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "repair the problems that are found")
+		flags.Parse(flag.Args()[1:])
+		problems := dbCheck(*repair)
+		db.Close()
+		myslog.Info("check", "unrepairedProblems", problems)
+		if problems > 0 {
+			os.Exit(1)
+		}
+		return
+	case "backup":
+		if flag.NArg() != 2 {
+			myslog.Error("usage: backup <backup.tar.gz>")
+			os.Exit(2)
+		}
+		if err := dbBackupFile(flag.Arg(1)); err != nil {
+			myslog.Error("backup", "err", err)
+			os.Exit(1)
+		}
+		db.Close()
+		return
+	default:
+		myslog.Error("unknown command", "command", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	developers, _ = dbReadAll("developer")
+	if dbCache != nil && DbCacheStatsInterval > 0 {
+		go dbCache.logStatsLoop(DbCacheStatsInterval)
+	}
+	registrations.Init()
 	hub := newHub()
 	go hub.run()
-	http.HandleFunc("/", serveHome)
+	if SessionSweepInterval > 0 {
+		go authSweepLoop(hub, SessionSweepInterval)
+	}
+	if ChatRetentionInterval > 0 {
+		go chatRetentionLoop(ChatRetentionInterval)
+	}
+	if ChatCompactInterval > 0 {
+		go chatCompactLoop(ChatCompactInterval)
+	}
+	http.HandleFunc("/", rateLimit(func(w http.ResponseWriter, r *http.Request) {
+		serveHome(hub, w, r)
+	}))
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Logs are only shown with -v
+	if !testing.Verbose() {
+		myslog = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	}
+	os.Exit(m.Run())
+}
+
+// testBackends are the storage backends that tests run against.
+var testBackends = []string{"memory", "file", "bolt"}
+
+// testDbInit opens a fresh, empty store with the given backend in a temporary
+// DATA_DIR, like dbInit does at startup.
+func testDbInit(t *testing.T, backend string) {
+	t.Helper()
+	DbBackend = backend
+	DataDir = t.TempDir()
+	dbCache, dbCrypt = nil, nil
+	chatLocks = sync.Map{}
+	chatLastTimestamp = sync.Map{}
+	dbInit()
+	registrations.Init()
+	t.Cleanup(func() { db.Close() })
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool, hops int64) { TrustProxy, TrustProxyHops = trust, hops }(TrustProxy, TrustProxyHops)
+	tests := []struct {
+		trust     bool
+		hops      int64
+		forwarded []string
+		want      string
+	}{
+		{false, 1, []string{"1.1.1.1"}, "10.0.0.1"},
+		{true, 1, nil, "10.0.0.1"},
+		{true, 1, []string{"1.1.1.1"}, "1.1.1.1"},
+		{true, 1, []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{true, 1, []string{"6.6.6.6", "1.1.1.1"}, "1.1.1.1"},
+		{true, 2, []string{"6.6.6.6, 1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{true, 3, []string{"1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{true, 0, []string{"1.1.1.1"}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		TrustProxy, TrustProxyHops = test.trust, test.hops
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for _, forwarded := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("clientIP(trust %v, hops %d, %q) = %q, want %q", test.trust, test.hops, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestImageMaxSize(t *testing.T) {
+	testDbInit(t, "memory")
+	defer func(size int64) { ImageMaxSize = size }(ImageMaxSize)
+	ImageMaxSize = 16
+	userId, ok := createUser()
+	if !ok {
+		t.Fatal("createUser failed")
+	}
+	sessionToken, ok := sessions.Create(userId, "test", "127.0.0.1")
+	if !ok {
+		t.Fatal("sessions.Create failed")
+	}
+	for _, test := range []struct {
+		size int
+		want int
+	}{{16, http.StatusOK}, {17, http.StatusRequestEntityTooLarge}, {1 << 20, http.StatusRequestEntityTooLarge}} {
+		r := httptest.NewRequest(http.MethodPost, "/image/a.png", strings.NewReader(strings.Repeat("a", test.size)))
+		r.Header.Set("Authorization", sessionToken)
+		w := httptest.NewRecorder()
+		serveHome(nil, w, r)
+		if w.Code != test.want {
+			t.Errorf("upload of %d bytes: got %d, want %d", test.size, w.Code, test.want)
+		}
+	}
+	if images, _ := dbReadAll("image"); len(images) != 1 {
+		t.Errorf("got %d images, want 1", len(images))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The data directory's schema version is kept in meta/version. Whenever the
+// format of stored records changes, add a migration to the end of migrations
+// that converts records from the previous version. Migrations run in order at
+// startup, after a backup of the data directory has been taken.
+type migration struct {
+	version int
+	name    string
+	// apply performs the migration, or only logs what it would change if
+	// dryRun is set
+	apply func(dryRun bool) error
+}
+
+var migrations = []migration{
+	{1, "split chat logs into segments", chatManifestInit},
+}
+
+func dbLatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// dbVersion returns the schema version of the data directory. Data
+// directories created before versioning have version 0.
+func dbVersion() (int, error) {
+	text, ok := dbRead("meta", "version")
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(string(text))
+}
+
+func dbSetVersion(version int) bool {
+	return dbWrite("meta", "version", []byte(strconv.Itoa(version)))
+}
+
+// dbIsEmpty reports whether the data directory holds no data yet.
+func dbIsEmpty() bool {
+	for _, table := range dbTables {
+		if keys, _ := dbKeys(table); len(keys) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// dbMigrate brings the data directory up to the latest schema version.
+func dbMigrate(dryRun bool) error {
+	version, err := dbVersion()
+	if err != nil {
+		return fmt.Errorf("invalid schema version: %w", err)
+	}
+	latest := dbLatestVersion()
+	if version > latest {
+		return fmt.Errorf("data directory has schema version %d but this server only supports up to %d", version, latest)
+	}
+	if version == latest {
+		return nil
+	}
+	if version == 0 && dbIsEmpty() {
+		if dryRun {
+			return nil
+		}
+		if !dbSetVersion(latest) {
+			return errors.New("failed to write schema version")
+		}
+		return nil
+	}
+
+	if !dryRun && DbBackend != "memory" {
+		path, err := dbBackupBeforeMigrate(version)
+		if err != nil {
+			return fmt.Errorf("backup before migrating failed: %w", err)
+		}
+		myslog.Info("backup before migrating", "path", path)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		myslog.Info("migrate", "version", m.version, "name", m.name, "dryRun", dryRun)
+		if err := m.apply(dryRun); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if dryRun {
+			continue
+		}
+		if !dbSetVersion(m.version) {
+			return errors.New("failed to write schema version")
+		}
+	}
+	return nil
+}
+
+func dbBackupBeforeMigrate(version int) (string, error) {
+	dir := DataDir + "/backups"
+	if err := os.MkdirAll(dir, dbPerm); err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf("%s/v%d-%s.tar.gz", dir, version, time.Now().UTC().Format("20060102T150405Z"))
+	return path, dbBackupFile(path)
+}
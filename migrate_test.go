@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSnapshot returns the contents of every file and directory under dir.
+func testSnapshot(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			files[path+"/"] = nil
+			return nil
+		}
+		files[path], err = os.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func testCompareSnapshots(t *testing.T, before, after map[string][]byte) {
+	t.Helper()
+	for path, value := range before {
+		if afterValue, ok := after[path]; !ok {
+			t.Errorf("%s was removed", path)
+		} else if !bytes.Equal(value, afterValue) {
+			t.Errorf("%s was changed", path)
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			t.Errorf("%s was created", path)
+		}
+	}
+}
+
+// testOldDataDir fills a data directory with the file layout at schema version
+// 0, with a torn chat log and a missing table directory.
+func testOldDataDir(t *testing.T, backend string) {
+	t.Helper()
+	testDbInit(t, backend)
+	userId, ok := createUser()
+	if !ok {
+		t.Fatal("createUser failed")
+	}
+	dbWrite("settings", userId, []byte(`{}`))
+	dbDelete("meta", "version")
+	db.Close()
+	if backend == "file" {
+		os.WriteFile(DataDir+"/chat_messages/global", []byte("{\"message\":\"a\"}\n{\"mess"), dbPerm)
+		os.RemoveAll(DataDir + "/invite")
+		os.RemoveAll(DataDir + "/.tmp")
+	}
+}
+
+func TestMigrateDryRunReadOnly(t *testing.T) {
+	for _, test := range []struct{ name, created, opened string }{
+		{"file", "file", "file"},
+		{"bolt", "bolt", "bolt"},
+		// The file layout would be imported into a new bolt database
+		{"file to bolt", "file", "bolt"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testOldDataDir(t, test.created)
+			before := testSnapshot(t, DataDir)
+
+			DbBackend = test.opened
+			dbInitReadOnly()
+			if err := dbMigrate(true); err != nil {
+				t.Error(err)
+			}
+			if version, _ := dbVersion(); version != 0 {
+				t.Errorf("schema version %d after dry run, want 0", version)
+			}
+			if dbWrite("meta", "version", []byte("1")) {
+				t.Error("write to read-only store succeeded")
+			}
+			db.Close()
+			testCompareSnapshots(t, before, testSnapshot(t, DataDir))
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users can log in with an OpenID Connect provider using the authorization
+// code flow. /oidc/login sends the browser to the provider, which sends it
+// back to /oidc/callback with a code. The code is exchanged for an ID token,
+// whose issuer and subject are mapped to a user in oidc_to_user_id, creating
+// the user the first time, and a session is started like with /login.
+//
+// The provider is trusted to authenticate its users, so two-factor
+// authentication isn't asked for. With REGISTRATION_INVITE_ONLY set, users who
+// log in for the first time need an invite code, passed to /oidc/login as
+// ?invite=<code> and kept with the pending login until the user is created.
+
+const (
+	// How long the browser has to come back from the provider
+	oidcLoginTimeout = 10 * time.Minute
+	// Maximum number of logins waiting for the browser to come back, in all
+	// and from each IP address
+	oidcMaxPending      = 10000
+	oidcMaxPendingPerIp = 10
+	// Keys are fetched again when an ID token has an unknown key id, but not
+	// more often than this
+	oidcKeysRefresh = time.Minute
+	oidcStateCookie = "harmon_oidc_state"
+)
+
+// oidcPending is a login that has been sent to the provider.
+type oidcPending struct {
+	nonce    string
+	verifier string
+	// Invite code given to /oidc/login, if any
+	invite  string
+	ip      string
+	created time.Time
+}
+
+// oidcClient talks to the provider in OIDC_ISSUER. It is safe for concurrent
+// use.
+type oidcClient struct {
+	http *http.Client
+
+	// Held while the configuration or keys are read or fetched
+	mu sync.Mutex
+	// From the provider's discovery document, fetched on first use
+	config *oidcConfig
+	// The provider's signing keys by key id
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+
+	// Logins waiting for the browser to come back, by state, and how many
+	// there are from each IP address
+	pendingMu   sync.Mutex
+	pending     map[string]oidcPending
+	pendingByIp map[string]int
+
+	// Held while a user is looked up or created
+	usersMu sync.Mutex
+}
+
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcClaims struct {
+	Iss   string       `json:"iss"`
+	Sub   string       `json:"sub"`
+	Aud   oidcAudience `json:"aud"`
+	Exp   int64        `json:"exp"`
+	Iat   int64        `json:"iat"`
+	Nonce string       `json:"nonce"`
+}
+
+// oidcAudience is the aud claim, which is either a string or a list of them.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = oidcAudience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+var (
+	errOidcInviteRequired = errors.New("invite code required")
+	errOidcInvalidInvite  = errors.New("invalid invite code")
+)
+
+var oidc = newOidcClient()
+
+func newOidcClient() *oidcClient {
+	return &oidcClient{
+		http:        &http.Client{Timeout: 10 * time.Second},
+		pending:     map[string]oidcPending{},
+		pendingByIp: map[string]int{},
+	}
+}
+
+func oidcEnabled() bool {
+	return OidcIssuer != "" && OidcClientId != "" && OidcRedirectUrl != ""
+}
+
+func base64url(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// getJSON fetches a JSON document from the provider.
+func (o *oidcClient) getJSON(uri string, v any) error {
+	res, err := o.http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", uri, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's configuration, fetching it the first time.
+func (o *oidcClient) discover() (*oidcConfig, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.config != nil {
+		return o.config, nil
+	}
+	config := &oidcConfig{}
+	if err := o.getJSON(strings.TrimSuffix(OidcIssuer, "/")+"/.well-known/openid-configuration", config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != OidcIssuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", config.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JwksUri == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	o.config = config
+	return config, nil
+}
+
+// key returns the provider's signing key with an id, fetching the keys again if
+// it is unknown. An empty id matches the only key, if there is just one.
+func (o *oidcClient) key(config *oidcConfig, kid string) (crypto.PublicKey, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	find := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(o.keys) == 1 {
+			for _, key := range o.keys {
+				return key, true
+			}
+		}
+		key, ok := o.keys[kid]
+		return key, ok
+	}
+	if key, ok := find(); ok || time.Since(o.keysFetched) < oidcKeysRefresh {
+		return key, ok
+	}
+	o.keysFetched = time.Now()
+	jwks := struct {
+		Keys []oidcJwk `json:"keys"`
+	}{}
+	if err := o.getJSON(config.JwksUri, &jwks); err != nil {
+		myslog.Error("oidc keys", "err", err)
+		return nil, false
+	}
+	o.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, ok := jwk.publicKey(); ok {
+			o.keys[jwk.Kid] = key
+		}
+	}
+	return find()
+}
+
+// publicKey decodes an RSA or P-256 key.
+func (jwk oidcJwk) publicKey() (crypto.PublicKey, bool) {
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n == nil || e == nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, false
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, true
+	case "EC":
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if jwk.Crv != "P-256" || x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, false
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, true
+	}
+	return nil, false
+}
+
+// verify checks an ID token's signature and claims and returns the claims.
+func (o *oidcClient) verify(config *oidcConfig, idToken, nonce string) (oidcClaims, error) {
+	claims := oidcClaims{}
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	headerText, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerText, &header) != nil {
+		return claims, errors.New("malformed ID token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed ID token signature")
+	}
+	key, ok := o.key(config, header.Kid)
+	if !ok {
+		return claims, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		ok = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		ok = header.Alg == "ES256" && len(signature) == 64 &&
+			ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	}
+	if !ok {
+		return claims, fmt.Errorf("invalid %s signature", header.Alg)
+	}
+
+	claimsText, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsText, &claims) != nil {
+		return claims, errors.New("malformed ID token claims")
+	}
+	now := time.Now().Unix()
+	audience := false
+	for _, aud := range claims.Aud {
+		audience = audience || aud == OidcClientId
+	}
+	switch {
+	case claims.Iss != config.Issuer:
+		return claims, fmt.Errorf("ID token is from issuer %q", claims.Iss)
+	case !audience:
+		return claims, errors.New("ID token is for another client")
+	case claims.Exp < now-60:
+		return claims, errors.New("ID token has expired")
+	case claims.Iat > now+60:
+		return claims, errors.New("ID token is from the future")
+	case claims.Nonce != nonce:
+		return claims, errors.New("ID token nonce does not match")
+	case claims.Sub == "":
+		return claims, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// exchange trades an authorization code for an ID token.
+func (o *oidcClient) exchange(config *oidcConfig, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", OidcRedirectUrl)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(OidcClientId), url.QueryEscape(OidcClientSecret))
+	res, err := o.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	body := struct {
+		IdToken string `json:"id_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IdToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return body.IdToken, nil
+}
+
+// user returns the user that an issuer and subject are mapped to, creating it
+// the first time. Creating a user uses the invite code, which is required with
+// REGISTRATION_INVITE_ONLY set.
+func (o *oidcClient) user(claims oidcClaims, code string) (userId string, err error) {
+	key := hashToken(claims.Iss + "\x00" + claims.Sub)
+	o.usersMu.Lock()
+	defer o.usersMu.Unlock()
+	if value, ok := dbRead("oidc_to_user_id", key); ok {
+		return string(value), nil
+	}
+	invite := ""
+	if code != "" {
+		var ok bool
+		if invite, ok = invites.Use(code); !ok {
+			return "", errOidcInvalidInvite
+		}
+	} else if RegistrationInviteOnly {
+		return "", errOidcInviteRequired
+	}
+	userId, ok := createUser()
+	if ok {
+		ok = dbWrite("oidc_to_user_id", key, []byte(userId))
+	}
+	if !ok {
+		if invite != "" {
+			invites.Release(invite)
+		}
+		return "", errors.New("failed to create user")
+	}
+	myslog.Info("oidc signup", "userId", userId)
+	if invite != "" {
+		invites.Attribute(invite, userId)
+		myslog.Info("invite used", "id", invite, "userId", userId)
+	}
+	return userId, nil
+}
+
+// addPending keeps a login until the browser comes back. The oldest login from
+// the same IP address, or from anyone if there are too many, makes room for
+// it, so that starting logins can't keep others from logging in.
+func (o *oidcClient) addPending(state string, pending oidcPending) {
+	o.pendingMu.Lock()
+	defer o.pendingMu.Unlock()
+	if o.pendingByIp[pending.ip] >= oidcMaxPendingPerIp {
+		o.evictPending(func(p oidcPending) bool { return p.ip == pending.ip })
+	}
+	if len(o.pending) >= oidcMaxPending {
+		for s, p := range o.pending {
+			if time.Since(p.created) > oidcLoginTimeout {
+				o.deletePending(s)
+			}
+		}
+	}
+	if len(o.pending) >= oidcMaxPending {
+		o.evictPending(func(oidcPending) bool { return true })
+	}
+	o.pending[state] = pending
+	o.pendingByIp[pending.ip]++
+}
+
+// takePending removes a login and returns it.
+func (o *oidcClient) takePending(state string) (oidcPending, bool) {
+	o.pendingMu.Lock()
+	defer o.pendingMu.Unlock()
+	pending, ok := o.pending[state]
+	if ok {
+		o.deletePending(state)
+	}
+	return pending, ok
+}
+
+// evictPending removes the oldest login for which match returns true. The
+// caller must hold o.pendingMu.
+func (o *oidcClient) evictPending(match func(oidcPending) bool) {
+	oldest := ""
+	for s, p := range o.pending {
+		if match(p) && (oldest == "" || p.created.Before(o.pending[oldest].created)) {
+			oldest = s
+		}
+	}
+	if oldest != "" {
+		o.deletePending(oldest)
+	}
+}
+
+// deletePending removes a login. The caller must hold o.pendingMu.
+func (o *oidcClient) deletePending(state string) {
+	ip := o.pending[state].ip
+	delete(o.pending, state)
+	if o.pendingByIp[ip]--; o.pendingByIp[ip] <= 0 {
+		delete(o.pendingByIp, ip)
+	}
+}
+
+// serveLogin sends the browser to the provider.
+func (o *oidcClient) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	config, err := o.discover()
+	if err != nil {
+		myslog.Error("oidc discovery", "err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := randomString(32)
+	pending := oidcPending{
+		nonce:    randomString(32),
+		verifier: randomString(64),
+		invite:   r.URL.Query().Get("invite"),
+		ip:       clientIP(r),
+		created:  time.Now(),
+	}
+	o.addPending(state, pending)
+
+	challenge := sha256.Sum256([]byte(pending.verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", OidcClientId)
+	query.Set("redirect_uri", OidcRedirectUrl)
+	query.Set("scope", OidcScopes)
+	query.Set("state", state)
+	query.Set("nonce", pending.nonce)
+	query.Set("code_challenge", base64url(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	uri := config.AuthorizationEndpoint
+	if strings.Contains(uri, "?") {
+		uri += "&" + query.Encode()
+	} else {
+		uri += "?" + query.Encode()
+	}
+
+	// The state is also kept in a cookie so that only the browser that
+	// started the login can finish it
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(OidcRedirectUrl, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// serveCallback finishes a login when the provider sends the browser back. The
+// session token is passed to OIDC_RETURN_URL in the fragment, or returned like
+// from /login if it isn't set.
+func (o *oidcClient) serveCallback(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || cookie.Value != state {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/oidc", MaxAge: -1})
+	pending, ok := o.takePending(state)
+	if !ok || time.Since(pending.created) > oidcLoginTimeout {
+		http.Error(w, "login expired", http.StatusBadRequest)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		myslog.Info("oidc login refused", "error", e, "description", query.Get("error_description"))
+		http.Error(w, "login refused by identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	config, err := o.discover()
+	if err != nil {
+		myslog.Error("oidc discovery", "err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	idToken, err := o.exchange(config, query.Get("code"), pending.verifier)
+	if err != nil {
+		myslog.Error("oidc token exchange", "err", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	claims, err := o.verify(config, idToken, pending.nonce)
+	if err != nil {
+		myslog.Error("oidc ID token", "err", err)
+		http.Error(w, "invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	userId, err := o.user(claims, pending.invite)
+	if err == errOidcInviteRequired || err == errOidcInvalidInvite {
+		myslog.Info("oidc signup refused", "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var sessionToken string
+	ok = err == nil
+	if ok {
+		sessionToken, ok = sessions.Create(userId, r.UserAgent(), clientIP(r))
+	}
+	if !ok {
+		http.Error(w, "login error", http.StatusInternalServerError)
+		return
+	}
+	myslog.Info("login", "userId", userId, "oidc", true)
+
+	if OidcReturnUrl != "" {
+		fragment := url.Values{}
+		fragment.Set("sessionToken", sessionToken)
+		fragment.Set("userId", userId)
+		http.Redirect(w, r, OidcReturnUrl+"#"+fragment.Encode(), http.StatusSeeOther)
+		return
+	}
+	resText, ok := loginResponse(userId, sessionToken)
+	if !ok {
+		http.Error(w, "login error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resText)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a mock OpenID Connect provider. The test registers the claims
+// of the ID token for each code before the browser comes back with it.
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testIssuerCode
+}
+
+type testIssuerCode struct {
+	challenge string
+	kid       string
+	claims    map[string]any
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, codes: map[string]testIssuerCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfig{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			JwksUri:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []oidcJwk{{
+			Kid: "k1",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64url(key.N.Bytes()),
+			E:   base64url(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, clientSecret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || clientId != OidcClientId || clientSecret != OidcClientSecret ||
+			r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != OidcRedirectUrl {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		issuer.mu.Lock()
+		code, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64url(challenge[:]) != code.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.sign(t, code.kid, code.claims)})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// sign returns an RS256 ID token.
+func (issuer *testIssuer) sign(t *testing.T, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64url(header) + "." + base64url(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64url(signature)
+}
+
+// testOidcSetup points the OIDC settings at a mock issuer and returns a client
+// that talks to it.
+func testOidcSetup(t *testing.T) (*testIssuer, *oidcClient) {
+	t.Helper()
+	testDbInit(t, "memory")
+	issuer := newTestIssuer(t)
+	saved := []string{OidcIssuer, OidcClientId, OidcClientSecret, OidcRedirectUrl, OidcReturnUrl}
+	t.Cleanup(func() {
+		OidcIssuer, OidcClientId, OidcClientSecret, OidcRedirectUrl, OidcReturnUrl = saved[0], saved[1], saved[2], saved[3], saved[4]
+	})
+	OidcIssuer = issuer.URL
+	OidcClientId = "harmon"
+	OidcClientSecret = "secret"
+	OidcRedirectUrl = "http://harmon.test/oidc/callback"
+	OidcReturnUrl = ""
+	o := newOidcClient()
+	o.http = issuer.Client()
+	return issuer, o
+}
+
+// testOidcStart runs /oidc/login from an IP address with an invite code, which
+// may be empty, and returns the state cookie and the query the browser is sent
+// to the provider with.
+func testOidcStart(t *testing.T, o *oidcClient, ip, invite string) (*http.Cookie, url.Values) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/oidc/login?"+url.Values{"invite": {invite}}.Encode(), nil)
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	o.serveLogin(w, r)
+	res := w.Result()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("/oidc/login: %s", res.Status)
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("/oidc/login set cookies %v", cookies)
+	}
+	return cookies[0], location.Query()
+}
+
+// testOidcFinish sends the browser back to /oidc/callback with a code.
+func testOidcFinish(o *oidcClient, cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	o.serveCallback(w, r)
+	return w
+}
+
+// testOidcLogin logs in with an invite code, which may be empty, and an ID
+// token whose claims edit may change, and returns the response of
+// /oidc/callback.
+func testOidcLogin(t *testing.T, issuer *testIssuer, o *oidcClient, invite, kid string, edit func(claims map[string]any)) *httptest.ResponseRecorder {
+	t.Helper()
+	cookie, query := testOidcStart(t, o, "192.0.2.1", invite)
+	now := time.Now().Unix()
+	claims := map[string]any{
+		"iss":   issuer.URL,
+		"sub":   "alice",
+		"aud":   OidcClientId,
+		"exp":   now + 300,
+		"iat":   now,
+		"nonce": query.Get("nonce"),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	code := randomString(16)
+	issuer.mu.Lock()
+	issuer.codes[code] = testIssuerCode{challenge: query.Get("code_challenge"), kid: kid, claims: claims}
+	issuer.mu.Unlock()
+	return testOidcFinish(o, cookie, query.Get("state"), code)
+}
+
+func TestOidcLogin(t *testing.T) {
+	issuer, o := testOidcSetup(t)
+
+	userIds := []string{}
+	for n := 0; n < 2; n++ {
+		w := testOidcLogin(t, issuer, o, "", "k1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login %d: %d %s", n, w.Code, w.Body)
+		}
+		res := LoginResponseBody{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if userId, ok := getUserId(res.SessionToken); !ok || userId != res.UserId {
+			t.Fatalf("login %d: session is for %q, %v, want %q", n, userId, ok, res.UserId)
+		}
+		userIds = append(userIds, res.UserId)
+	}
+	if userIds[0] != userIds[1] {
+		t.Errorf("logging in again gave user %s, want %s", userIds[1], userIds[0])
+	}
+}
+
+func TestOidcLoginRejectsToken(t *testing.T) {
+	tests := []struct {
+		name string
+		kid  string
+		edit func(claims map[string]any)
+	}{
+		{"wrong audience", "k1", func(claims map[string]any) { claims["aud"] = []string{"other"} }},
+		{"wrong nonce", "k1", func(claims map[string]any) { claims["nonce"] = "other" }},
+		{"wrong issuer", "k1", func(claims map[string]any) { claims["iss"] = "https://other.test" }},
+		{"expired", "k1", func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"unknown key", "k2", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer, o := testOidcSetup(t)
+			w := testOidcLogin(t, issuer, o, "", test.kid, test.edit)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, http.StatusUnauthorized)
+			}
+			if keys, _ := dbKeys("session"); len(keys) != 0 {
+				t.Errorf("%d sessions were started", len(keys))
+			}
+			if keys, _ := dbKeys("oidc_to_user_id"); len(keys) != 0 {
+				t.Errorf("%d users were created", len(keys))
+			}
+		})
+	}
+}
+
+// TestOidcPendingPerIp checks that logins started from one IP address only
+// push out that address's own logins.
+func TestOidcPendingPerIp(t *testing.T) {
+	_, o := testOidcSetup(t)
+
+	other, otherQuery := testOidcStart(t, o, "192.0.2.2", "")
+	type login struct {
+		cookie *http.Cookie
+		state  string
+	}
+	logins := []login{}
+	for n := 0; n < oidcMaxPendingPerIp+5; n++ {
+		cookie, query := testOidcStart(t, o, "192.0.2.1", "")
+		logins = append(logins, login{cookie, query.Get("state")})
+	}
+	if n := len(o.pending); n != oidcMaxPendingPerIp+1 {
+		t.Errorf("%d logins pending, want %d", n, oidcMaxPendingPerIp+1)
+	}
+	if n := o.pendingByIp["192.0.2.1"]; n != oidcMaxPendingPerIp {
+		t.Errorf("%d logins pending from 192.0.2.1, want %d", n, oidcMaxPendingPerIp)
+	}
+
+	// The oldest logins were pushed out, the others are still waiting
+	for n, l := range logins {
+		w := testOidcFinish(o, l.cookie, l.state, "")
+		evicted := n < len(logins)-oidcMaxPendingPerIp
+		if got := w.Code == http.StatusBadRequest && w.Body.String() == "login expired\n"; got != evicted {
+			t.Errorf("login %d: got %d %q, evicted %v", n, w.Code, w.Body, evicted)
+		}
+	}
+	if w := testOidcFinish(o, other, otherQuery.Get("state"), ""); w.Code == http.StatusBadRequest {
+		t.Errorf("login from another IP address: got %d %q", w.Code, w.Body)
+	}
+	if len(o.pending) != 0 || len(o.pendingByIp) != 0 {
+		t.Errorf("logins still pending: %v %v", o.pending, o.pendingByIp)
+	}
+}
+
+func TestOidcAudienceList(t *testing.T) {
+	issuer, o := testOidcSetup(t)
+	w := testOidcLogin(t, issuer, o, "", "k1", func(claims map[string]any) {
+		claims["aud"] = []string{"other", OidcClientId}
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOidcLoginInviteOnly(t *testing.T) {
+	issuer, o := testOidcSetup(t)
+	defer func(inviteOnly bool) { RegistrationInviteOnly = inviteOnly }(RegistrationInviteOnly)
+	RegistrationInviteOnly = true
+	_, code, id, ok := invites.Create("", 1, 0)
+	if !ok {
+		t.Fatal("invites.Create failed")
+	}
+
+	// A new user needs a valid invite code
+	for _, invite := range []string{"", "wrong"} {
+		w := testOidcLogin(t, issuer, o, invite, "k1", nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("invite %q: got %d %s, want %d", invite, w.Code, w.Body, http.StatusForbidden)
+		}
+	}
+	if keys, _ := dbKeys("oidc_to_user_id"); len(keys) != 0 {
+		t.Fatalf("%d users were created without an invite", len(keys))
+	}
+
+	w := testOidcLogin(t, issuer, o, code, "k1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login with invite: %d %s", w.Code, w.Body)
+	}
+	res := LoginResponseBody{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	text, _ := dbRead("invite", id)
+	invite := Invite{}
+	json.Unmarshal(text, &invite)
+	if invite.Uses != 1 || len(invite.Users) != 1 || invite.Users[0] != res.UserId {
+		t.Errorf("invite has %d uses by %v, want 1 by %s", invite.Uses, invite.Users, res.UserId)
+	}
+
+	// The invite is used up, but the user doesn't need it anymore, while
+	// another new user can't use it
+	if w := testOidcLogin(t, issuer, o, "", "k1", nil); w.Code != http.StatusOK {
+		t.Errorf("logging in again: %d %s", w.Code, w.Body)
+	}
+	w = testOidcLogin(t, issuer, o, code, "k1", func(claims map[string]any) { claims["sub"] = "bob" })
+	if w.Code != http.StatusForbidden {
+		t.Errorf("used up invite: got %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Users can attach a password to their account so that they can log in with
+// their username and password if they lose their login token. Passwords are
+// hashed with argon2id and kept in the password table, keyed by user id.
+type Password struct {
+	// The hash in the PHC string format, which includes its parameters so
+	// that they can be raised without breaking existing passwords
+	Hash    string `json:"hash"`
+	Changed int64  `json:"changed"`
+}
+
+// Parameters of new password hashes
+const (
+	passwordTime    = 2
+	passwordMemory  = 19 * 1024
+	passwordThreads = 1
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+const (
+	passwordMinLength = 8
+	passwordMaxLength = 256
+)
+
+// Compared against when a username doesn't exist, so that a login takes as
+// long whether or not it does
+var passwordDummyHash = hashPassword(randomString(passwordMinLength))
+
+func validPassword(password string) bool {
+	return len(password) >= passwordMinLength && len(password) <= passwordMaxLength
+}
+
+// hashPassword returns the argon2id hash of a password with a random salt.
+func hashPassword(password string) string {
+	salt := make([]byte, passwordSaltLen)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, passwordTime, passwordMemory, passwordThreads, passwordKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, passwordMemory, passwordTime, passwordThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword reports whether a password matches a hash from hashPassword.
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// hasPassword reports whether a user has set a password.
+func hasPassword(userId string) bool {
+	return dbExists("password", userId)
+}
+
+// checkPassword reports whether a password is the user's password.
+func checkPassword(userId, password string) bool {
+	text, ok := dbRead("password", userId)
+	p := Password{}
+	if !ok || json.Unmarshal(text, &p) != nil {
+		verifyPassword(passwordDummyHash, password)
+		return false
+	}
+	return verifyPassword(p.Hash, password)
+}
+
+// setPassword replaces a user's password.
+func setPassword(userId, password string) bool {
+	if !validPassword(password) {
+		return false
+	}
+	text, _ := json.Marshal(Password{Hash: hashPassword(password), Changed: time.Now().UnixMilli()})
+	return dbWrite("password", userId, text)
+}
+
+// resetPassword replaces a user's password with a random one and returns it.
+func resetPassword(userId string) (string, bool) {
+	password := randomString(20)
+	return password, setPassword(userId, password)
+}
+
+// loginWithPassword returns the user with a username if password is their
+// password. ip is only logged.
+func loginWithPassword(username, password, ip string) (userId string, ok bool) {
+	if !dbValidKey(username) || len(password) > passwordMaxLength {
+		return "", false
+	}
+	value, ok := dbRead("username_to_user_id", username)
+	if !ok {
+		verifyPassword(passwordDummyHash, password)
+		return "", false
+	}
+	userId = string(value)
+	if !checkPassword(userId, password) {
+		myslog.Info("wrong password", "userId", userId, "ip", ip)
+		return "", false
+	}
+	return userId, true
+}
+
+// passwordCommand runs the password command: "reset <username>" gives a user a
+// new random password, which is printed, and "clear <username>" removes a
+// user's password.
+func passwordCommand(args []string) bool {
+	if len(args) != 2 || !dbValidKey(args[1]) {
+		myslog.Error("usage: password [reset <username> | clear <username>]")
+		return false
+	}
+	value, ok := dbRead("username_to_user_id", args[1])
+	if !ok {
+		myslog.Error("no such user", "username", args[1])
+		return false
+	}
+	userId := string(value)
+	switch args[0] {
+	case "reset":
+		password, ok := resetPassword(userId)
+		if !ok {
+			return false
+		}
+		myslog.Info("password reset", "userId", userId)
+		fmt.Println(password)
+	case "clear":
+		dbDelete("password", userId)
+		myslog.Info("password cleared", "userId", userId)
+	default:
+		myslog.Error("unknown password command", "command", args[0])
+		return false
+	}
+	return true
+}
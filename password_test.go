@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testPasswordUser creates a user with a password and returns their id and
+// username.
+func testPasswordUser(t *testing.T, password string) (userId, username string) {
+	t.Helper()
+	userId, ok := createUser()
+	if !ok || !setPassword(userId, password) {
+		t.Fatal("createUser or setPassword failed")
+	}
+	userText, _ := dbRead("user", userId)
+	user := User{}
+	json.Unmarshal(userText, &user)
+	return userId, user.Username
+}
+
+func TestLoginWithPassword(t *testing.T) {
+	testDbInit(t, "memory")
+	userId, username := testPasswordUser(t, "password123")
+	withoutPassword, ok := createUser()
+	if !ok {
+		t.Fatal("createUser failed")
+	}
+	userText, _ := dbRead("user", withoutPassword)
+	user := User{}
+	json.Unmarshal(userText, &user)
+
+	if got, ok := loginWithPassword(username, "password123", "127.0.0.1"); !ok || got != userId {
+		t.Errorf("loginWithPassword = %q, %v, want %q, true", got, ok, userId)
+	}
+	for _, test := range []struct {
+		name               string
+		username, password string
+	}{
+		{"wrong password", username, "password124"},
+		{"unknown username", "nobody", "password123"},
+		{"invalid username", "../user", "password123"},
+		{"user without a password", user.Username, "password123"},
+		{"empty password", user.Username, ""},
+		{"long password", username, string(make([]byte, passwordMaxLength+1))},
+	} {
+		if got, ok := loginWithPassword(test.username, test.password, "127.0.0.1"); ok {
+			t.Errorf("%s: loginWithPassword = %q, true", test.name, got)
+		}
+	}
+
+	w := testLogin(t, LoginRequestBody{Username: username, Password: "password123"})
+	res := LoginResponseBody{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &res) != nil || res.UserId != userId {
+		t.Errorf("/login = %d %q", w.Code, w.Body)
+	}
+	if _, ok := sessions.Get(res.SessionToken); !ok {
+		t.Error("/login returned an invalid session token")
+	}
+	if w := testLogin(t, LoginRequestBody{Username: username, Password: "password124"}); w.Code == http.StatusOK {
+		t.Error("/login succeeded with a wrong password")
+	}
+}
+
+func TestChangePasswordAction(t *testing.T) {
+	testDbInit(t, "memory")
+	c := testConnect(t, testHub())
+
+	// The first password doesn't need a current one
+	if replies := c.replies(ChangePasswordAction, ChangePassword{NewPassword: "password123"}); len(replies) != 1 {
+		t.Fatalf("setting the first password got %d replies", len(replies))
+	}
+	if !checkPassword(c.userId, "password123") {
+		t.Fatal("first password wasn't set")
+	}
+
+	for _, test := range []struct {
+		name string
+		r    ChangePassword
+	}{
+		{"no current password", ChangePassword{NewPassword: "password456"}},
+		{"wrong current password", ChangePassword{CurrentPassword: "password124", NewPassword: "password456"}},
+		{"short new password", ChangePassword{CurrentPassword: "password123", NewPassword: "short"}},
+	} {
+		if replies := c.replies(ChangePasswordAction, test.r); len(replies) != 0 {
+			t.Errorf("%s: got %d replies", test.name, len(replies))
+		}
+		if !checkPassword(c.userId, "password123") {
+			t.Fatalf("%s: password changed", test.name)
+		}
+	}
+
+	replies := c.replies(ChangePasswordAction, ChangePassword{CurrentPassword: "password123", NewPassword: "password456"})
+	if len(replies) != 1 {
+		t.Fatalf("changing the password got %d replies", len(replies))
+	}
+	if r := (ChangePassword{}); json.Unmarshal(replies[0].Data, &r) != nil || r.CurrentPassword != "" || r.NewPassword != "" {
+		t.Errorf("reply contains the passwords: %s", replies[0].Data)
+	}
+	if !checkPassword(c.userId, "password456") || checkPassword(c.userId, "password123") {
+		t.Error("password wasn't changed")
+	}
+}
+
+func TestResetPasswordAction(t *testing.T) {
+	testDbInit(t, "memory")
+	c := testConnect(t, testHub())
+	userId, _ := testPasswordUser(t, "password123")
+	t.Cleanup(func() { developers = nil })
+
+	developers = nil
+	if replies := c.replies(ResetPasswordAction, ResetPassword{UserId: userId}); len(replies) != 0 {
+		t.Errorf("non-developer got %d replies", len(replies))
+	}
+	if !checkPassword(userId, "password123") {
+		t.Fatal("non-developer reset a password")
+	}
+
+	developers = map[string][]byte{c.userId: []byte("{}")}
+	replies := c.replies(ResetPasswordAction, ResetPassword{UserId: userId})
+	if len(replies) != 1 {
+		t.Fatalf("developer got %d replies", len(replies))
+	}
+	r := ResetPassword{}
+	json.Unmarshal(replies[0].Data, &r)
+	if r.UserId != userId || !checkPassword(userId, r.Password) || checkPassword(userId, "password123") {
+		t.Errorf("reset replied %s, which isn't the new password", replies[0].Data)
+	}
+
+	// Users that don't exist don't get a password
+	if replies := c.replies(ResetPasswordAction, ResetPassword{UserId: "missing"}); len(replies) != 0 || hasPassword("missing") {
+		t.Errorf("reset of a missing user got %d replies", len(replies))
+	}
+}
+
+// TestLoginUserLimit checks that failing to log in to an account from one
+// address doesn't lock its owner out from another.
+func TestLoginUserLimit(t *testing.T) {
+	defer func(l *rateLimiter) { loginUserLimiter = l }(loginUserLimiter)
+	loginUserLimiter = newRateLimiter("login user", rate{3, time.Hour})
+	testDbInit(t, "memory")
+	_, username := testPasswordUser(t, "password123")
+
+	wrong := LoginRequestBody{Username: username, Password: "password124"}
+	for i := 0; i < 3; i++ {
+		if w := testLoginFrom(t, "192.0.2.66", wrong); w.Code == http.StatusOK || w.Code == http.StatusTooManyRequests {
+			t.Fatalf("wrong password %d = %d", i, w.Code)
+		}
+	}
+	if w := testLoginFrom(t, "192.0.2.66", wrong); w.Code != http.StatusTooManyRequests {
+		t.Errorf("guessing after the limit = %d, want 429", w.Code)
+	}
+	if w := testLoginFrom(t, "192.0.2.1", LoginRequestBody{Username: username, Password: "password123"}); w.Code != http.StatusOK {
+		t.Errorf("owner's login from another address = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests to /register, /login and POST /image are limited per client IP
+// address, uploads are also limited per user, failed passwords per account and
+// IP address and failed two-factor codes per account.
+// Every limit is a token bucket that holds up to n tokens and refills at n
+// every per. A request takes a token, and a request that finds the bucket
+// empty gets 429 with Retry-After.
+
+// rateLimiter is a set of token buckets with the same limit, by key. A nil
+// rateLimiter allows everything. It is safe for concurrent use.
+type rateLimiter struct {
+	name  string
+	burst float64
+	// Tokens added per second
+	rate float64
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	// Whether a request was turned away since the last one was allowed, so
+	// that only the first is logged
+	limited bool
+}
+
+// How often buckets that have refilled are forgotten
+const rateSweepInterval = time.Minute
+
+func newRateLimiter(name string, limit rate) *rateLimiter {
+	if limit.n <= 0 || limit.per <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		name:    name,
+		burst:   float64(limit.n),
+		rate:    float64(limit.n) / limit.per.Seconds(),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+var (
+	registerIpLimiter = newRateLimiter("register ip", RateLimitRegisterIp)
+	loginIpLimiter    = newRateLimiter("login ip", RateLimitLoginIp)
+	loginUserLimiter  = newRateLimiter("login user", RateLimitLoginUser)
+	imageIpLimiter    = newRateLimiter("image ip", RateLimitImageIp)
+	imageUserLimiter  = newRateLimiter("image user", RateLimitImageUser)
+)
+
+// take takes a token from key's bucket if consume is set, or only checks that
+// there is one. If there is none, it returns how long until there is.
+func (l *rateLimiter) take(key string, consume bool) (retryAfter time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateSweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		retryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return retryAfter, false
+	}
+	if consume {
+		b.tokens--
+	}
+	b.limited = false
+	return 0, true
+}
+
+// allow takes a token from key's bucket. If there is none, it responds with
+// 429 and returns false.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request, key string) bool {
+	retryAfter, ok := l.take(key, true)
+	if !ok {
+		l.reject(w, r, key, retryAfter)
+	}
+	return ok
+}
+
+// check is like allow, but doesn't take a token. It is used with fail for
+// limits that only count failed requests.
+func (l *rateLimiter) check(w http.ResponseWriter, r *http.Request, key string) bool {
+	retryAfter, ok := l.take(key, false)
+	if !ok {
+		l.reject(w, r, key, retryAfter)
+	}
+	return ok
+}
+
+// fail takes a token from key's bucket after a failed request.
+func (l *rateLimiter) fail(key string) {
+	l.take(key, true)
+}
+
+func (l *rateLimiter) reject(w http.ResponseWriter, r *http.Request, key string, retryAfter time.Duration) {
+	l.mu.Lock()
+	b := l.buckets[key]
+	logged := b == nil || b.limited
+	if b != nil {
+		b.limited = true
+	}
+	l.mu.Unlock()
+	if !logged {
+		myslog.Warn("rate limited", "limit", l.name, "key", key, "path", r.URL.Path, "ip", clientIP(r), "retryAfter", retryAfter.String())
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// rateLimit applies the per-IP limits, and the per-user limit of POST /image,
+// before next.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload := strings.HasPrefix(r.URL.Path, "/image") && r.Method == http.MethodPost
+		var limiter *rateLimiter
+		switch {
+		case r.Method == http.MethodOptions:
+		case r.URL.Path == "/register":
+			limiter = registerIpLimiter
+		case r.URL.Path == "/login" || strings.HasPrefix(r.URL.Path, "/oidc/"):
+			limiter = loginIpLimiter
+		case upload:
+			limiter = imageIpLimiter
+		}
+		if limiter != nil && !limiter.allow(w, r, clientIP(r)) {
+			return
+		}
+		if upload {
+			if userId, ok := getUserId(r.Header.Get("Authorization")); ok && !imageUserLimiter.allow(w, r, userId) {
+				return
+			}
+		}
+		next(w, r)
+	}
+}
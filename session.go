@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Sessions are stored in the session table so they survive restarts. They
+// are keyed by a hash of the session token, so the tokens themselves are
+// never stored. The key doubles as the session's id, which lets users list
+// and revoke their sessions without seeing their tokens.
+type Session struct {
+	UserId   string `json:"userId"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastUsed"`
+
+	// The device the session was created from
+	UserAgent string `json:"userAgent"`
+	Ip        string `json:"ip"`
+}
+
+// How often LastUsed is saved while a session is in use
+const sessionTouchInterval = time.Minute
+
+func (s Session) expired(now time.Time) bool {
+	if SessionIdleTimeout > 0 && now.Sub(time.UnixMilli(s.LastUsed)) > SessionIdleTimeout {
+		return true
+	}
+	return SessionMaxAge > 0 && now.Sub(time.UnixMilli(s.Created)) > SessionMaxAge
+}
+
+// sessionStore holds the sessions in the session table. It is safe for
+// concurrent use by HTTP handlers and every client's readPump: sessions are
+// only created with Create, changed with Update and removed with Delete, which
+// are atomic in every Store, and a session that has been deleted is never
+// written again.
+type sessionStore struct {
+	table string
+}
+
+var sessions = &sessionStore{table: "session"}
+
+// Create starts a new session for a user and returns its token.
+func (s *sessionStore) Create(userId, userAgent, ip string) (sessionToken string, ok bool) {
+	now := time.Now().UnixMilli()
+	session := Session{UserId: userId, Created: now, LastUsed: now, UserAgent: userAgent, Ip: ip}
+	text, _ := json.Marshal(session)
+	for i := 0; i < 10; i++ {
+		sessionToken = randomSessionToken()
+		if dbCreate(s.table, hashToken(sessionToken), text) {
+			return sessionToken, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the session of a session token if it hasn't expired and marks
+// it as used.
+func (s *sessionStore) Get(sessionToken string) (Session, bool) {
+	session := Session{}
+	if sessionToken == "" {
+		return session, false
+	}
+	key := hashToken(sessionToken)
+	text, ok := dbRead(s.table, key)
+	if !ok || json.Unmarshal(text, &session) != nil {
+		return session, false
+	}
+	now := time.Now()
+	if session.expired(now) {
+		dbDelete(s.table, key)
+		return session, false
+	}
+	if now.Sub(time.UnixMilli(session.LastUsed)) >= sessionTouchInterval {
+		// Only touch the session if it still exists, so a session deleted
+		// in the meantime stays deleted
+		dbUpdate(s.table, key, func(text []byte, ok bool) ([]byte, bool) {
+			current := Session{}
+			if !ok || json.Unmarshal(text, &current) != nil {
+				return nil, false
+			}
+			current.LastUsed = now.UnixMilli()
+			text, _ = json.Marshal(current)
+			return text, true
+		})
+	}
+	return session, true
+}
+
+// Delete ends a session and returns its id. It fails if there is no such
+// session.
+func (s *sessionStore) Delete(sessionToken string) (id string, ok bool) {
+	if sessionToken == "" {
+		return "", false
+	}
+	id = hashToken(sessionToken)
+	if !dbDelete(s.table, id) {
+		return "", false
+	}
+	return id, true
+}
+
+// Revoke ends one of a user's sessions by id. It fails if there is no such
+// session or it was ended in the meantime.
+func (s *sessionStore) Revoke(userId, id string) bool {
+	text, ok := dbRead(s.table, id)
+	session := Session{}
+	if !ok || json.Unmarshal(text, &session) != nil || session.UserId != userId {
+		return false
+	}
+	return dbDelete(s.table, id)
+}
+
+// RevokeOthers ends every session of a user except the one with id keep, and
+// returns the ids of the sessions it ended.
+func (s *sessionStore) RevokeOthers(userId, keep string) (revoked []string) {
+	for _, session := range s.List(userId) {
+		if session.Id != keep && s.Revoke(userId, session.Id) {
+			revoked = append(revoked, session.Id)
+		}
+	}
+	return revoked
+}
+
+// List returns a user's sessions that haven't expired, oldest first.
+func (s *sessionStore) List(userId string) []SessionInfo {
+	values, _ := dbReadAll(s.table)
+	now := time.Now()
+	list := []SessionInfo{}
+	for id, text := range values {
+		session := Session{}
+		if json.Unmarshal(text, &session) != nil || session.UserId != userId || session.expired(now) {
+			continue
+		}
+		list = append(list, SessionInfo{
+			Id:        id,
+			UserAgent: session.UserAgent,
+			Ip:        session.Ip,
+			Created:   session.Created,
+			LastUsed:  session.LastUsed,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	return list
+}
+
+// Sweep deletes every expired session and returns their ids.
+func (s *sessionStore) Sweep() (removed []string) {
+	values, _ := dbReadAll(s.table)
+	now := time.Now()
+	for key, text := range values {
+		session := Session{}
+		if json.Unmarshal(text, &session) == nil && !session.expired(now) {
+			continue
+		}
+		dbDelete(s.table, key)
+		removed = append(removed, key)
+	}
+	if len(removed) > 0 {
+		myslog.Info("sessions expired", "removed", len(removed), "remaining", len(values)-len(removed))
+	}
+	return removed
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSessionsConcurrent hammers registration, login and session lookups from
+// many goroutines, and races logouts against lookups. Run it with -race.
+func TestSessionsConcurrent(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			testDbInit(t, backend)
+
+			const workers, rounds = 16, 20
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					if err := sessionsHammer(w, rounds); err != nil {
+						errs <- err
+						return
+					}
+					errs <- sessionsRace(w, rounds)
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			if n := registrations.Pending(); n != 0 {
+				t.Errorf("%d registrations still pending", n)
+			}
+		})
+	}
+}
+
+func sessionsHammer(w, rounds int) error {
+	token, ok := registrations.Issue("")
+	if !ok {
+		return fmt.Errorf("worker %d: Issue failed", w)
+	}
+	userId, ok := login(token)
+	if !ok {
+		return fmt.Errorf("worker %d: login with registration token failed", w)
+	}
+	for i := 0; i < rounds; i++ {
+		// The login token keeps working after registration
+		if id, ok := login(token); !ok || id != userId {
+			return fmt.Errorf("worker %d: login returned %q, %v", w, id, ok)
+		}
+		sessionToken, ok := sessions.Create(userId, "test", "127.0.0.1")
+		if !ok {
+			return fmt.Errorf("worker %d: Create failed", w)
+		}
+		for j := 0; j < 5; j++ {
+			if id, ok := getUserId(sessionToken); !ok || id != userId {
+				return fmt.Errorf("worker %d: getUserId returned %q, %v", w, id, ok)
+			}
+		}
+		if _, ok := sessions.Delete(sessionToken); !ok {
+			return fmt.Errorf("worker %d: Delete failed", w)
+		}
+		if _, ok := getUserId(sessionToken); ok {
+			return fmt.Errorf("worker %d: session still valid after Delete", w)
+		}
+		if _, ok := sessions.Delete(sessionToken); ok {
+			return fmt.Errorf("worker %d: session deleted twice", w)
+		}
+	}
+	// A registration token can only be used once to register
+	if _, ok := registrations.Use(token); ok {
+		return fmt.Errorf("worker %d: registration token reused", w)
+	}
+	return nil
+}
+
+// sessionsRace ends sessions from two goroutines while two others look them
+// up. Only one of the logouts succeeds, and a lookup that saves LastUsed
+// doesn't bring the session back.
+func sessionsRace(w, rounds int) error {
+	for i := 0; i < rounds; i++ {
+		sessionToken, ok := sessions.Create("user", "test", "127.0.0.1")
+		if !ok {
+			return fmt.Errorf("worker %d: Create failed", w)
+		}
+		// Make every lookup save LastUsed
+		key := hashToken(sessionToken)
+		text, _ := dbRead("session", key)
+		session := Session{}
+		json.Unmarshal(text, &session)
+		session.LastUsed -= 2 * sessionTouchInterval.Milliseconds()
+		text, _ = json.Marshal(session)
+		dbWrite("session", key, text)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		deleted := 0
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				if g%2 == 0 {
+					sessions.Get(sessionToken)
+					return
+				}
+				if _, ok := sessions.Delete(sessionToken); ok {
+					mu.Lock()
+					deleted++
+					mu.Unlock()
+				}
+			}(g)
+		}
+		wg.Wait()
+		if deleted != 1 {
+			return fmt.Errorf("worker %d: %d logouts succeeded, want 1", w, deleted)
+		}
+		if dbExists("session", key) {
+			return fmt.Errorf("worker %d: session exists after logout", w)
+		}
+	}
+	return nil
+}
+
+func TestSessionSweepDisconnects(t *testing.T) {
+	testDbInit(t, "memory")
+	hub := testHub()
+	c := testConnect(t, hub)
+	other := testConnect(t, hub)
+	// The session was last used long ago, but the client is still connected
+	id := hashToken(c.sessionToken)
+	text, _ := dbRead("session", id)
+	session := Session{}
+	json.Unmarshal(text, &session)
+	session.LastUsed = 0
+	text, _ = json.Marshal(session)
+	dbWrite("session", id, text)
+
+	authSweep(hub)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := c.conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("got %v, want the connection closed for the expired session", err)
+		}
+	}
+	if dbExists("session", id) {
+		t.Error("expired session wasn't deleted")
+	}
+	// Clients of other sessions stay connected, and replies fails otherwise
+	other.replies(GetMySessionsAction, nil)
+}
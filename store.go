@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Store is a storage backend for the db* functions. Data is organized into
+// tables, each of which maps string keys to byte values. Values in some
+// tables (e.g. chat_messages) are append-only logs with one JSON object per
+// line.
+type Store interface {
+	// Init prepares the store to hold the given tables.
+	Init(tables []string) error
+	Read(table, key string) (value []byte, ok bool)
+	Write(table, key string, value []byte) bool
+	Exists(table, key string) bool
+	Append(table, key string, value []byte) bool
+	// Delete removes a key and reports whether it existed.
+	Delete(table, key string) (deleted bool)
+	// Update atomically replaces the value of key with the value returned by
+	// fn. fn is passed the current value (ok is false if there is none) and
+	// returns write=false to leave the value unchanged. Update reports
+	// whether a new value was written. fn must not access the store.
+	Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool
+	// Create writes value only if key does not exist yet.
+	Create(table, key string, value []byte) bool
+	ReadAll(table string) (values map[string]([]byte), ok bool)
+	Keys(table string) (keys []string, ok bool)
+	// Size returns the length of a value in bytes.
+	Size(table, key string) (size int64, ok bool)
+	// ReadRange reads up to length bytes of a value starting at offset.
+	ReadRange(table, key string, offset int64, length int) (value []byte, ok bool)
+	// ReadEntries constructs a JSON array from the lines of a value starting
+	// at the given offset. See readEntries.
+	ReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool)
+	Close() error
+}
+
+func openStore(backend, dataDir string) (Store, error) {
+	switch backend {
+	case "file":
+		if DbSync != "off" && DbSync != "normal" && DbSync != "full" {
+			return nil, fmt.Errorf("unknown DB_SYNC %q", DbSync)
+		}
+		return newFileStore(dataDir), nil
+	case "memory":
+		return newMemStore(), nil
+	case "bolt":
+		return newBoltStore(dataDir), nil
+	}
+	return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+}
+
+// openStoreReadOnly opens an existing store only for reading, for commands
+// that must not change any data. Unlike Init, it doesn't create directories,
+// recover torn logs or import the file layout into bolt, and every write
+// fails.
+func openStoreReadOnly(backend, dataDir string) (Store, error) {
+	switch backend {
+	case "file":
+		return readOnlyStore{newFileStore(dataDir)}, nil
+	case "memory":
+		store := newMemStore()
+		return readOnlyStore{store}, store.Init(dbTables)
+	case "bolt":
+		store := newBoltStore(dataDir)
+		if _, err := os.Stat(store.path); os.IsNotExist(err) {
+			// Read the file layout that would be imported
+			return readOnlyStore{newFileStore(dataDir)}, nil
+		}
+		return readOnlyStore{store}, store.openReadOnly()
+	}
+	return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+}
+
+// readOnlyStore refuses every write to the store it wraps.
+type readOnlyStore struct {
+	Store
+}
+
+func (s readOnlyStore) refuse(op, table, key string) {
+	myslog.Warn("write to read-only store", "op", op, "table", table, "key", key)
+}
+
+func (s readOnlyStore) Init(tables []string) error {
+	return nil
+}
+
+func (s readOnlyStore) Write(table, key string, value []byte) bool {
+	s.refuse("write", table, key)
+	return false
+}
+
+func (s readOnlyStore) Append(table, key string, value []byte) bool {
+	s.refuse("append", table, key)
+	return false
+}
+
+func (s readOnlyStore) Delete(table, key string) bool {
+	s.refuse("delete", table, key)
+	return false
+}
+
+func (s readOnlyStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	s.refuse("update", table, key)
+	return false
+}
+
+func (s readOnlyStore) Create(table, key string, value []byte) bool {
+	s.refuse("create", table, key)
+	return false
+}
+
+var errDataDirLocked = errors.New("data directory is in use by another process")
+
+// readRange reads up to length bytes from r starting at offset.
+func readRange(r io.ReaderAt, offset int64, length int) (value []byte, ok bool) {
+	if offset < 0 || length < 0 {
+		return nil, false
+	}
+	value = make([]byte, length)
+	n, err := r.ReadAt(value, offset)
+	if err != nil && err != io.EOF {
+		return nil, false
+	}
+	return value[:n], true
+}
+
+// Constructs a valid JSON array from a portion of a reader containing one JSON object per line
+func readEntries(r io.ReadSeeker, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	newOffset, err := r.Seek(int64(offset), whence)
+
+	// If the offset is invalid, just start at the beginning of the file.
+	skip := true
+	if err != nil {
+		newOffset, err = r.Seek(0, io.SeekStart)
+		// We don't need to skip the first line since it will be valid JSON
+		skip = false
+		if err != nil {
+			return nil, 0, 0, false
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Allocate enough space for JSON objects with '[' and ']' characters
+	data := make([]byte, total+2)
+	data[0] = '[' // Open bracket for new JSON array
+	i := 1
+	for scanner.Scan() {
+		// Skip first line since it is probably invalid JSON (we most likely seeked into the middle of a line)
+		if skip {
+			skip = false
+			continue
+		}
+		if i >= total {
+			i = total
+			break
+		}
+		bytes := scanner.Bytes()
+		end := i + len(bytes)
+		if end > total {
+			break
+		}
+		// Skip empty lines, which would otherwise leave a gap in the array
+		if len(bytes) == 0 {
+			continue
+		}
+		copy(data[i:end], bytes)
+		data[end] = ',' // Insert commas to construct array
+		i = end + 1
+	}
+	data[i-1] = ']' // Replace very last comma to finish closing array
+	return data[0:i], newOffset, i - 1, true
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps every table in a single bbolt database file. Each table is
+// a bucket. Append-only values are stored as a nested bucket of chunks keyed
+// by the big-endian byte offset at which each chunk starts, so appends don't
+// rewrite the whole value and ranged reads only touch the chunks they need.
+type boltStore struct {
+	dataDir string
+	path    string
+	bolt    *bolt.DB
+	// Releases the lock on the data directory taken by Init
+	unlock func()
+}
+
+func newBoltStore(dataDir string) *boltStore {
+	return &boltStore{dataDir: dataDir, path: dataDir + "/harmon.db"}
+}
+
+func (s *boltStore) Init(tables []string) (err error) {
+	if err := os.MkdirAll(s.dataDir, dbPerm); err != nil {
+		return err
+	}
+	s.unlock, err = lockDataDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.unlock()
+		}
+	}()
+	_, err = os.Stat(s.path)
+	created := os.IsNotExist(err)
+
+	s.bolt, err = bolt.Open(s.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = s.bolt.Update(func(tx *bolt.Tx) error {
+		for _, table := range tables {
+			if _, err := tx.CreateBucketIfNotExists([]byte(table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if created {
+		if err := s.migrateFromFiles(tables); err != nil {
+			s.bolt.Close()
+			os.Remove(s.path)
+			return err
+		}
+	}
+	return nil
+}
+
+// openReadOnly opens an existing database file for reading, see
+// openStoreReadOnly.
+func (s *boltStore) openReadOnly() (err error) {
+	s.bolt, err = bolt.Open(s.path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	return err
+}
+
+// migrateFromFiles imports an existing directory-per-table layout from the
+// data directory the first time the database file is created. It runs in a
+// single transaction so a failed import leaves nothing behind, and fails if a
+// table directory can't be read completely.
+func (s *boltStore) migrateFromFiles(tables []string) error {
+	if info, err := os.Stat(s.dataDir + "/user"); err != nil || !info.IsDir() {
+		return nil
+	}
+	files := newFileStore(s.dataDir)
+	n := 0
+	err := s.bolt.Update(func(tx *bolt.Tx) error {
+		for _, table := range tables {
+			values, ok := files.ReadAll(table)
+			if !ok {
+				if _, err := os.Stat(files.tablePath(table)); os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("can't read table %s to migrate it", table)
+			}
+			b := tx.Bucket([]byte(table))
+			for key, value := range values {
+				if dbIsLogTable(table) {
+					if err := boltAppend(b, key, value); err != nil {
+						return err
+					}
+				} else if err := b.Put([]byte(key), value); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		myslog.Info("migrated data directory to bolt", "path", s.path, "records", n)
+	}
+	return err
+}
+
+func (s *boltStore) Read(table, key string) (value []byte, ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		value, ok = boltGet(tx.Bucket([]byte(table)), key)
+		return nil
+	})
+	return value, ok
+}
+
+func (s *boltStore) Exists(table, key string) bool {
+	ok := false
+	s.bolt.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(table)); b != nil {
+			k, _ := b.Cursor().Seek([]byte(key))
+			ok = k != nil && string(k) == key
+		}
+		return nil
+	})
+	return ok
+}
+
+func (s *boltStore) ReadAll(table string) (values map[string]([]byte), ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		values = map[string]([]byte){}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)], _ = boltGet(b, string(k))
+			return nil
+		})
+	})
+	return values, values != nil
+}
+
+func (s *boltStore) Keys(table string) (keys []string, ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		keys = []string{}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, keys != nil
+}
+
+func (s *boltStore) Size(table, key string) (size int64, ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		if log := b.Bucket([]byte(key)); log != nil {
+			size, ok = boltLogSize(log), true
+		} else if v := b.Get([]byte(key)); v != nil {
+			size, ok = int64(len(v)), true
+		}
+		return nil
+	})
+	return size, ok
+}
+
+func (s *boltStore) ReadRange(table, key string, offset int64, length int) (value []byte, ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		if log := b.Bucket([]byte(key)); log != nil {
+			value, ok = readRange(newBoltLogReader(log), offset, length)
+		} else if v := b.Get([]byte(key)); v != nil {
+			value, ok = readRange(bytes.NewReader(v), offset, length)
+		}
+		return nil
+	})
+	return value, ok
+}
+
+func (s *boltStore) ReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	s.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		var r io.ReadSeeker
+		if log := b.Bucket([]byte(key)); log != nil {
+			r = newBoltLogReader(log)
+		} else if v := b.Get([]byte(key)); v != nil {
+			r = bytes.NewReader(v)
+		} else {
+			return nil
+		}
+		value, newOffset, newTotal, ok = readEntries(r, offset, whence, total)
+		return nil
+	})
+	return value, newOffset, newTotal, ok
+}
+
+func (s *boltStore) Write(table, key string, value []byte) bool {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return bolt.ErrBucketNotFound
+		}
+		if b.Bucket([]byte(key)) != nil {
+			if err := b.DeleteBucket([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(key), value)
+	}) == nil
+}
+
+// errNoWrite aborts an Update transaction without reporting a failure.
+var errNoWrite = errors.New("no write")
+
+func (s *boltStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return bolt.ErrBucketNotFound
+		}
+		value, write := fn(boltGet(b, key))
+		if !write {
+			return errNoWrite
+		}
+		if b.Bucket([]byte(key)) != nil {
+			if err := b.DeleteBucket([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(key), value)
+	}) == nil
+}
+
+func (s *boltStore) Create(table, key string, value []byte) bool {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return bolt.ErrBucketNotFound
+		}
+		if b.Get([]byte(key)) != nil || b.Bucket([]byte(key)) != nil {
+			return errNoWrite
+		}
+		return b.Put([]byte(key), value)
+	}) == nil
+}
+
+func (s *boltStore) Append(table, key string, value []byte) bool {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return bolt.ErrBucketNotFound
+		}
+		return boltAppend(b, key, value)
+	}) == nil
+}
+
+func (s *boltStore) Delete(table, key string) bool {
+	deleted := false
+	err := s.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return nil
+		}
+		if b.Bucket([]byte(key)) != nil {
+			deleted = true
+			return b.DeleteBucket([]byte(key))
+		}
+		deleted = b.Get([]byte(key)) != nil
+		return b.Delete([]byte(key))
+	})
+	return err == nil && deleted
+}
+
+func (s *boltStore) Close() error {
+	err := s.bolt.Close()
+	if s.unlock != nil {
+		s.unlock()
+	}
+	return err
+}
+
+// boltGet reads a plain value, or concatenates the chunks of an append-only
+// value. The result is copied so it remains valid after the transaction.
+func boltGet(b *bolt.Bucket, key string) (value []byte, ok bool) {
+	if b == nil {
+		return nil, false
+	}
+	if log := b.Bucket([]byte(key)); log != nil {
+		value = []byte{}
+		log.ForEach(func(_, chunk []byte) error {
+			value = append(value, chunk...)
+			return nil
+		})
+		return value, true
+	}
+	if v := b.Get([]byte(key)); v != nil {
+		return bytes.Clone(v), true
+	}
+	return nil, false
+}
+
+func boltAppend(b *bolt.Bucket, key string, value []byte) error {
+	log := b.Bucket([]byte(key))
+	if log == nil {
+		// Convert a plain value into the first chunk of a log
+		existing := bytes.Clone(b.Get([]byte(key)))
+		if existing != nil {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		var err error
+		if log, err = b.CreateBucket([]byte(key)); err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			if err := log.Put(boltOffsetKey(0), existing); err != nil {
+				return err
+			}
+		}
+	}
+	if len(value) == 0 {
+		return nil
+	}
+	return log.Put(boltOffsetKey(boltLogSize(log)), bytes.Clone(value))
+}
+
+func boltOffsetKey(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+func boltLogSize(log *bolt.Bucket) int64 {
+	k, v := log.Cursor().Last()
+	if k == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(k)) + int64(len(v))
+}
+
+// boltLogReader is an io.ReadSeeker over the chunks of an append-only value.
+// It is only valid for the lifetime of the transaction it was created in.
+type boltLogReader struct {
+	cursor *bolt.Cursor
+	size   int64
+	pos    int64
+}
+
+func newBoltLogReader(log *bolt.Bucket) *boltLogReader {
+	return &boltLogReader{cursor: log.Cursor(), size: boltLogSize(log)}
+}
+
+func (r *boltLogReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("boltLogReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("boltLogReader.Seek: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *boltLogReader) ReadAt(p []byte, offset int64) (n int, err error) {
+	r.pos = offset
+	for n < len(p) && err == nil {
+		var m int
+		m, err = r.Read(p[n:])
+		n += m
+	}
+	return n, err
+}
+
+func (r *boltLogReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	// Find the chunk containing pos
+	k, v := r.cursor.Seek(boltOffsetKey(r.pos))
+	if k == nil || int64(binary.BigEndian.Uint64(k)) > r.pos {
+		k, v = r.cursor.Prev()
+	}
+	start := int64(binary.BigEndian.Uint64(k))
+	n = copy(p, v[r.pos-start:])
+	r.pos += int64(n)
+	return n, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tables that are kept in memory by cacheStore. These are small and read on
+// every websocket message.
+var dbCachedTables = []string{
+	"token_to_user_id",
+	"username_to_user_id",
+	"user",
+	"settings",
+	"developer",
+	"chat_manifest",
+	"session",
+}
+
+// cacheStore is a write-through cache in front of another Store. Reads of
+// cached tables are served from memory once loaded. Writes to cached tables go
+// to the underlying store first and then update the cache. The cache's locks
+// are not held while the underlying store is read or written: writes of the
+// same key are ordered by a lock of their own, and reads that missed the cache
+// only fill it if nothing was written to the table meanwhile, so the cache
+// never holds a value older than the store.
+type cacheStore struct {
+	Store
+
+	tables map[string]*cacheTable
+}
+
+// How many keys known not to exist are kept per table
+const cacheMaxMissing = 10000
+
+// How many locks writes of a table's keys are spread over
+const cacheKeyLocks = 64
+
+type cacheTable struct {
+	// Guards values, missing, complete and gen
+	mu     sync.RWMutex
+	values map[string][]byte
+	// Keys known not to exist
+	missing map[string]bool
+	// Whether values holds every key of the table
+	complete bool
+	// Counts writes, so that a read of the store that raced with a write
+	// isn't cached
+	gen uint64
+
+	// Held by writes of a key while they write the store and update the
+	// cache, so that the cache is updated in the order the store was
+	keyLocks [cacheKeyLocks]sync.Mutex
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newCacheStore(store Store, tables []string) *cacheStore {
+	s := &cacheStore{Store: store, tables: map[string]*cacheTable{}}
+	for _, table := range tables {
+		s.tables[table] = &cacheTable{values: map[string][]byte{}, missing: map[string]bool{}}
+	}
+	return s
+}
+
+// lockKey locks the writes of a key and returns the unlock function.
+func (t *cacheTable) lockKey(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &t.keyLocks[h.Sum32()%cacheKeyLocks]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (s *cacheStore) Read(table, key string) (value []byte, ok bool) {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Read(table, key)
+	}
+	t.mu.RLock()
+	value, ok = t.values[key]
+	known := ok || t.missing[key] || t.complete
+	gen := t.gen
+	t.mu.RUnlock()
+	if known {
+		t.hits.Add(1)
+		return bytes.Clone(value), ok
+	}
+	t.misses.Add(1)
+
+	value, ok = s.Store.Read(table, key)
+	t.mu.Lock()
+	if t.gen == gen {
+		t.set(key, value, ok)
+	}
+	t.mu.Unlock()
+	return value, ok
+}
+
+func (s *cacheStore) Exists(table, key string) bool {
+	if _, cached := s.tables[table]; !cached {
+		return s.Store.Exists(table, key)
+	}
+	_, ok := s.Read(table, key)
+	return ok
+}
+
+func (s *cacheStore) ReadAll(table string) (values map[string]([]byte), ok bool) {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.ReadAll(table)
+	}
+	t.mu.RLock()
+	complete := t.complete
+	if complete {
+		values = make(map[string][]byte, len(t.values))
+		for key, value := range t.values {
+			values[key] = bytes.Clone(value)
+		}
+	}
+	gen := t.gen
+	t.mu.RUnlock()
+	if complete {
+		t.hits.Add(1)
+		return values, true
+	}
+	t.misses.Add(1)
+
+	values, ok = s.Store.ReadAll(table)
+	if !ok {
+		return nil, false
+	}
+	t.mu.Lock()
+	if t.gen == gen {
+		t.values = make(map[string][]byte, len(values))
+		t.missing = map[string]bool{}
+		for key, value := range values {
+			t.values[key] = bytes.Clone(value)
+		}
+		t.complete = true
+	}
+	t.mu.Unlock()
+	return values, true
+}
+
+func (s *cacheStore) Keys(table string) (keys []string, ok bool) {
+	if _, cached := s.tables[table]; !cached {
+		return s.Store.Keys(table)
+	}
+	values, ok := s.ReadAll(table)
+	if !ok {
+		return nil, false
+	}
+	keys = make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+func (s *cacheStore) Write(table, key string, value []byte) bool {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Write(table, key, value)
+	}
+	defer t.lockKey(key)()
+	ok := s.Store.Write(table, key, value)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		t.set(key, value, true)
+	} else {
+		// A failed write may have left either value in the store
+		t.forget(key)
+	}
+	return ok
+}
+
+func (s *cacheStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Update(table, key, fn)
+	}
+	defer t.lockKey(key)()
+	var value []byte
+	ok := s.Store.Update(table, key, func(oldValue []byte, exists bool) ([]byte, bool) {
+		var write bool
+		value, write = fn(oldValue, exists)
+		return value, write
+	})
+	if ok {
+		t.mu.Lock()
+		t.set(key, value, true)
+		t.mu.Unlock()
+	}
+	return ok
+}
+
+func (s *cacheStore) Create(table, key string, value []byte) bool {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Create(table, key, value)
+	}
+	defer t.lockKey(key)()
+	ok := s.Store.Create(table, key, value)
+	if ok {
+		t.mu.Lock()
+		t.set(key, value, true)
+		t.mu.Unlock()
+	}
+	return ok
+}
+
+func (s *cacheStore) Append(table, key string, value []byte) bool {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Append(table, key, value)
+	}
+	defer t.lockKey(key)()
+	ok := s.Store.Append(table, key, value)
+	t.mu.Lock()
+	t.forget(key)
+	t.mu.Unlock()
+	return ok
+}
+
+func (s *cacheStore) Delete(table, key string) bool {
+	t, cached := s.tables[table]
+	if !cached {
+		return s.Store.Delete(table, key)
+	}
+	defer t.lockKey(key)()
+	deleted := s.Store.Delete(table, key)
+	exists := s.Store.Exists(table, key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forget(key)
+	if !exists {
+		t.set(key, nil, false)
+	}
+	return deleted
+}
+
+// set caches the value of a key. The caller must hold t.mu.
+func (t *cacheTable) set(key string, value []byte, ok bool) {
+	t.gen++
+	if ok {
+		t.values[key] = bytes.Clone(value)
+		delete(t.missing, key)
+	} else {
+		delete(t.values, key)
+		if !t.complete {
+			// Misses are for keys anyone can ask for, like session tokens,
+			// so they are forgotten when there are too many
+			if len(t.missing) >= cacheMaxMissing {
+				t.missing = map[string]bool{}
+			}
+			t.missing[key] = true
+		}
+	}
+}
+
+// forget drops a key from the cache so it is read from the store next time.
+// The caller must hold t.mu.
+func (t *cacheTable) forget(key string) {
+	t.gen++
+	delete(t.values, key)
+	delete(t.missing, key)
+	t.complete = false
+}
+
+// logStats logs the hit and miss counts of each cached table since the last
+// call.
+func (s *cacheStore) logStats() {
+	for table, t := range s.tables {
+		hits, misses := t.hits.Swap(0), t.misses.Swap(0)
+		if hits == 0 && misses == 0 {
+			continue
+		}
+		t.mu.RLock()
+		size := len(t.values)
+		t.mu.RUnlock()
+		myslog.Info("cache", "table", table, "hits", hits, "misses", misses, "size", size)
+	}
+}
+
+func (s *cacheStore) logStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.logStats()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheMissingBounded(t *testing.T) {
+	store := newMemStore()
+	store.Init([]string{"session"})
+	s := newCacheStore(store, []string{"session"})
+	for i := 0; i < 3*cacheMaxMissing; i++ {
+		if _, ok := s.Read("session", fmt.Sprint("missing", i)); ok {
+			t.Fatal("read a key that doesn't exist")
+		}
+	}
+	if n := len(s.tables["session"].missing); n > cacheMaxMissing {
+		t.Errorf("%d missing keys cached, want at most %d", n, cacheMaxMissing)
+	}
+
+	// A key that was cached as missing is found once it's written
+	s.Read("session", "a")
+	s.Write("session", "a", []byte("1"))
+	if value, ok := s.Read("session", "a"); !ok || string(value) != "1" {
+		t.Errorf("Read = %q, %v, want 1", value, ok)
+	}
+}
+
+// blockingStore blocks writes until release is closed.
+type blockingStore struct {
+	Store
+	started chan bool
+	release chan bool
+}
+
+func (s *blockingStore) Write(table, key string, value []byte) bool {
+	s.started <- true
+	<-s.release
+	return s.Store.Write(table, key, value)
+}
+
+func TestCacheReadDuringWrite(t *testing.T) {
+	store := newMemStore()
+	store.Init([]string{"session"})
+	store.Write("session", "a", []byte("1"))
+	blocking := &blockingStore{Store: store, started: make(chan bool), release: make(chan bool)}
+	s := newCacheStore(blocking, []string{"session"})
+	s.Read("session", "a")
+
+	done := make(chan bool)
+	go func() {
+		s.Write("session", "b", []byte("2"))
+		done <- true
+	}()
+	<-blocking.started
+	// Reads don't wait for the write to the store
+	if value, ok := s.Read("session", "a"); !ok || string(value) != "1" {
+		t.Errorf("Read = %q, %v, want 1", value, ok)
+	}
+	if _, ok := s.Read("session", "c"); ok {
+		t.Error("read a key that doesn't exist")
+	}
+	close(blocking.release)
+	<-done
+	if value, ok := s.Read("session", "b"); !ok || string(value) != "2" {
+		t.Errorf("Read = %q, %v, want 2", value, ok)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	store := newMemStore()
+	store.Init([]string{"session"})
+	s := newCacheStore(store, []string{"session"})
+	keys := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := keys[i%len(keys)]
+				switch (w + i) % 6 {
+				case 0:
+					s.Write("session", key, []byte(fmt.Sprint(w, i)))
+				case 1:
+					s.Delete("session", key)
+				case 2:
+					s.Update("session", key, func(value []byte, ok bool) ([]byte, bool) {
+						return append(value, 'u'), true
+					})
+				case 3:
+					s.Create("session", key, []byte("c"))
+				case 4:
+					s.ReadAll("session")
+				default:
+					s.Read("session", key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, key := range keys {
+		want, wantOk := store.Read("session", key)
+		if value, ok := s.Read("session", key); ok != wantOk || string(value) != string(want) {
+			t.Errorf("cache has %q, %v for %s, store has %q, %v", value, ok, key, want, wantOk)
+		}
+	}
+	all, _ := s.ReadAll("session")
+	for _, key := range keys {
+		want, _ := store.Read("session", key)
+		if string(all[key]) != string(want) {
+			t.Errorf("ReadAll has %q for %s, store has %q", all[key], key, want)
+		}
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+)
+
+// cryptStore encrypts the values of another Store. Each value is encrypted
+// with its own random data key, which is stored next to it wrapped with a key
+// from the keyring. Rotating the keyring only needs the data keys to be
+// rewrapped, which the encrypt command does along with encrypting any values
+// that are still plain text.
+//
+// Values of tables that are appended to are encrypted with AES-CTR so that
+// they can be appended to and read by range without decrypting the whole
+// value. Other values are encrypted with AES-GCM. Keys are not encrypted.
+//
+// Values that don't start with cryptMagic are plain text and are read as is,
+// so a data directory can be encrypted while it is in use. Appending to a
+// plain text log keeps it plain text until the encrypt command is run.
+type cryptStore struct {
+	Store
+	keyring *cryptKeyring
+
+	// Serializes changes to each value, since an append needs the value's
+	// current header and size to encrypt at the right position
+	locks [256]sync.Mutex
+
+	// Unwrapped data keys of stream values, by header
+	mu      sync.Mutex
+	streams map[string]cipher.Block
+}
+
+// Tables that are appended to and are encrypted as a stream
+var cryptStreamTables = []string{
+	"chat_messages",
+	"chat_index",
+	"chat_edits",
+}
+
+const (
+	cryptMagic      = "HENC"
+	cryptModeGCM    = 'G'
+	cryptModeStream = 'C'
+	cryptKeyIdSize  = 8
+	cryptKeySize    = 32
+	cryptNonceSize  = 12
+
+	// magic, mode, key id, wrap nonce, wrapped data key and its tag
+	cryptWrapSize = len(cryptMagic) + 1 + cryptKeyIdSize + cryptNonceSize + cryptKeySize + 16
+	// Followed by the nonce and the sealed value
+	cryptGCMHeaderSize = cryptWrapSize + cryptNonceSize
+	// Followed by the initial counter and the encrypted stream
+	cryptStreamHeaderSize = cryptWrapSize + aes.BlockSize
+)
+
+type cryptKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// cryptKeyring holds the keys that data keys are wrapped with. The first key
+// wraps new data keys and the others can still unwrap old ones.
+type cryptKeyring struct {
+	keys []cryptKey
+}
+
+// cryptLoadKeyring reads the keyring from DB_ENCRYPTION_KEY or the file at
+// DB_ENCRYPTION_KEY_FILE, which hold base64 encoded 32 byte keys separated by
+// commas or newlines. It returns nil if encryption isn't configured.
+func cryptLoadKeyring() (*cryptKeyring, error) {
+	text := DbEncryptionKey
+	if DbEncryptionKeyFile != "" {
+		if text != "" {
+			return nil, errors.New("only one of DB_ENCRYPTION_KEY and DB_ENCRYPTION_KEY_FILE can be set")
+		}
+		data, err := os.ReadFile(DbEncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	keyring := &cryptKeyring{}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != cryptKeySize {
+			return nil, fmt.Errorf("encryption key %d is not %d base64 encoded bytes", len(keyring.keys)+1, cryptKeySize)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(key)
+		keyring.keys = append(keyring.keys, cryptKey{id: id[:cryptKeyIdSize], aead: aead})
+	}
+	if len(keyring.keys) == 0 {
+		return nil, nil
+	}
+	return keyring, nil
+}
+
+func (k *cryptKeyring) find(id []byte) (cryptKey, bool) {
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			return key, true
+		}
+	}
+	return cryptKey{}, false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newCryptStore(store Store, keyring *cryptKeyring) *cryptStore {
+	return &cryptStore{Store: store, keyring: keyring, streams: map[string]cipher.Block{}}
+}
+
+func cryptIsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(cryptMagic))
+}
+
+func cryptIsStream(table string) bool {
+	for _, t := range cryptStreamTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// cryptAAD binds a value to its table and key, so that encrypted values can't
+// be swapped between keys. Data keys are also bound to the key that wraps
+// them.
+func cryptAAD(table, key string, mode byte, keyId []byte) []byte {
+	aad := append([]byte(cryptMagic), mode)
+	aad = append(aad, keyId...)
+	return append(aad, table+"/"+key...)
+}
+
+// wrap returns the start of a header for a new value with a new data key.
+func (s *cryptStore) wrap(table, key string, mode byte) (header []byte, dataKey []byte, err error) {
+	dataKey = make([]byte, cryptKeySize)
+	nonce := make([]byte, cryptNonceSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	current := s.keyring.keys[0]
+	header = append([]byte(cryptMagic), mode)
+	header = append(header, current.id...)
+	header = append(header, nonce...)
+	header = current.aead.Seal(header, nonce, dataKey, cryptAAD(table, key, mode, current.id))
+	return header, dataKey, nil
+}
+
+// unwrap returns the data key of an encrypted value.
+func (s *cryptStore) unwrap(table, key string, header []byte) ([]byte, error) {
+	if len(header) < cryptWrapSize {
+		return nil, errors.New("encrypted value is too short")
+	}
+	if s.keyring == nil {
+		return nil, errors.New("value is encrypted but no encryption key is configured")
+	}
+	idStart := len(cryptMagic) + 1
+	nonceStart := idStart + cryptKeyIdSize
+	wrapped := header[nonceStart+cryptNonceSize : cryptWrapSize]
+	k, ok := s.keyring.find(header[idStart:nonceStart])
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with unknown key %x", header[idStart:nonceStart])
+	}
+	aad := cryptAAD(table, key, header[len(cryptMagic)], k.id)
+	return k.aead.Open(nil, header[nonceStart:nonceStart+cryptNonceSize], wrapped, aad)
+}
+
+// rewrap wraps the data key of an encrypted value with the current key.
+func (s *cryptStore) rewrap(table, key string, value []byte) ([]byte, error) {
+	dataKey, err := s.unwrap(table, key, value)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, cryptNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	current := s.keyring.keys[0]
+	mode := value[len(cryptMagic)]
+	header := append([]byte(cryptMagic), mode)
+	header = append(header, current.id...)
+	header = append(header, nonce...)
+	header = current.aead.Seal(header, nonce, dataKey, cryptAAD(table, key, mode, current.id))
+	return append(header, value[cryptWrapSize:]...), nil
+}
+
+func (s *cryptStore) encrypt(table, key string, value []byte) ([]byte, error) {
+	if cryptIsStream(table) {
+		header, dataKey, err := s.wrap(table, key, cryptModeStream)
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return nil, err
+		}
+		header = append(header, iv...)
+		block, err := aes.NewCipher(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		data := append(header, make([]byte, len(value))...)
+		cryptStream(block, iv, 0).XORKeyStream(data[len(header):], value)
+		return data, nil
+	}
+	header, dataKey, err := s.wrap(table, key, cryptModeGCM)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, cryptNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, value, cryptAAD(table, key, cryptModeGCM, nil)), nil
+}
+
+func (s *cryptStore) decrypt(table, key string, value []byte) ([]byte, error) {
+	if !cryptIsEncrypted(value) {
+		return value, nil
+	}
+	if len(value) <= len(cryptMagic) {
+		return nil, errors.New("encrypted value is too short")
+	}
+	switch value[len(cryptMagic)] {
+	case cryptModeStream:
+		block, err := s.streamBlock(table, key, value)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, len(value)-cryptStreamHeaderSize)
+		cryptStream(block, value[cryptWrapSize:cryptStreamHeaderSize], 0).XORKeyStream(data, value[cryptStreamHeaderSize:])
+		return data, nil
+	case cryptModeGCM:
+		if len(value) < cryptGCMHeaderSize {
+			return nil, errors.New("encrypted value is too short")
+		}
+		dataKey, err := s.unwrap(table, key, value)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, value[cryptWrapSize:cryptGCMHeaderSize], value[cryptGCMHeaderSize:], cryptAAD(table, key, cryptModeGCM, nil))
+	}
+	return nil, errors.New("unknown encryption mode")
+}
+
+// streamBlock returns the cipher for the data key of a stream value.
+func (s *cryptStore) streamBlock(table, key string, header []byte) (cipher.Block, error) {
+	if len(header) < cryptStreamHeaderSize {
+		return nil, errors.New("encrypted value is too short")
+	}
+	header = header[:cryptStreamHeaderSize]
+	s.mu.Lock()
+	block, ok := s.streams[string(header)]
+	s.mu.Unlock()
+	if ok {
+		return block, nil
+	}
+	dataKey, err := s.unwrap(table, key, header)
+	if err != nil {
+		return nil, err
+	}
+	block, err = aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.streams[string(header)] = block
+	s.mu.Unlock()
+	return block, nil
+}
+
+// cryptStream returns an AES-CTR stream positioned at offset.
+func cryptStream(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	// Add the block number to the big-endian counter
+	carry := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// streamHeader reads the header of a stream value. It returns nil if the
+// value is plain text.
+func (s *cryptStore) streamHeader(table, key string) (header []byte, ok bool) {
+	header, ok = s.Store.ReadRange(table, key, 0, cryptStreamHeaderSize)
+	if !ok {
+		return nil, false
+	}
+	if !cryptIsEncrypted(header) {
+		return nil, true
+	}
+	return header, true
+}
+
+func (s *cryptStore) fail(op, table, key string, err error) {
+	myslog.Error("crypt "+op, "table", table, "key", key, "err", err)
+}
+
+func (s *cryptStore) Init(tables []string) error {
+	if err := s.Store.Init(tables); err != nil {
+		return err
+	}
+	if _, ok := s.Store.(*fileStore); !ok {
+		return nil
+	}
+	// The file store can't see the lines of encrypted logs, so torn trailing
+	// lines are truncated here instead
+	for _, table := range tables {
+		if !dbIsLogTable(table) || !cryptIsStream(table) {
+			continue
+		}
+		keys, _ := s.Store.Keys(table)
+		for _, key := range keys {
+			header, ok := s.streamHeader(table, key)
+			if !ok || header == nil {
+				continue
+			}
+			value, ok := s.Read(table, key)
+			if !ok {
+				continue
+			}
+			size := bytes.LastIndexByte(value, '\n') + 1
+			if size == len(value) {
+				continue
+			}
+			// Reencrypt with a new data key rather than truncating, so the
+			// torn bytes' key stream is never reused
+			if !s.Write(table, key, value[:size]) {
+				myslog.Error("recover log", "table", table, "key", key)
+				continue
+			}
+			myslog.Warn("recover log", "table", table, "key", key, "truncatedBytes", len(value)-size)
+		}
+	}
+	return nil
+}
+
+func (s *cryptStore) Read(table, key string) ([]byte, bool) {
+	value, ok := s.Store.Read(table, key)
+	if !ok {
+		return nil, false
+	}
+	value, err := s.decrypt(table, key, value)
+	if err != nil {
+		s.fail("read", table, key, err)
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *cryptStore) Write(table, key string, value []byte) bool {
+	defer s.lock(table, key).Unlock()
+	return s.write(table, key, value)
+}
+
+// write is Write for callers that hold the value's lock.
+func (s *cryptStore) write(table, key string, value []byte) bool {
+	value, err := s.encrypt(table, key, value)
+	if err != nil {
+		s.fail("write", table, key, err)
+		return false
+	}
+	return s.Store.Write(table, key, value)
+}
+
+func (s *cryptStore) Create(table, key string, value []byte) bool {
+	defer s.lock(table, key).Unlock()
+	value, err := s.encrypt(table, key, value)
+	if err != nil {
+		s.fail("write", table, key, err)
+		return false
+	}
+	return s.Store.Create(table, key, value)
+}
+
+func (s *cryptStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	defer s.lock(table, key).Unlock()
+	failed := false
+	ok := s.Store.Update(table, key, func(value []byte, ok bool) ([]byte, bool) {
+		if ok {
+			var err error
+			if value, err = s.decrypt(table, key, value); err != nil {
+				s.fail("read", table, key, err)
+				failed = true
+				return nil, false
+			}
+		}
+		value, write := fn(value, ok)
+		if !write {
+			return nil, false
+		}
+		value, err := s.encrypt(table, key, value)
+		if err != nil {
+			s.fail("write", table, key, err)
+			failed = true
+			return nil, false
+		}
+		return value, true
+	})
+	return ok && !failed
+}
+
+func (s *cryptStore) lock(table, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(table))
+	h.Write([]byte{'/'})
+	h.Write([]byte(key))
+	l := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	l.Lock()
+	return l
+}
+
+func (s *cryptStore) Delete(table, key string) bool {
+	defer s.lock(table, key).Unlock()
+	return s.Store.Delete(table, key)
+}
+
+func (s *cryptStore) Append(table, key string, value []byte) bool {
+	if !cryptIsStream(table) {
+		return s.Update(table, key, func(old []byte, ok bool) ([]byte, bool) {
+			return append(old, value...), true
+		})
+	}
+	defer s.lock(table, key).Unlock()
+	size, exists := s.Store.Size(table, key)
+	if !exists || size == 0 {
+		data, err := s.encrypt(table, key, value)
+		if err != nil {
+			s.fail("write", table, key, err)
+			return false
+		}
+		return s.Store.Append(table, key, data)
+	}
+	header, ok := s.streamHeader(table, key)
+	if !ok {
+		return false
+	}
+	if header == nil {
+		return s.Store.Append(table, key, value)
+	}
+	block, err := s.streamBlock(table, key, header)
+	if err != nil {
+		s.fail("write", table, key, err)
+		return false
+	}
+	data := make([]byte, len(value))
+	cryptStream(block, header[cryptWrapSize:], size-int64(cryptStreamHeaderSize)).XORKeyStream(data, value)
+	return s.Store.Append(table, key, data)
+}
+
+func (s *cryptStore) ReadAll(table string) (map[string]([]byte), bool) {
+	values, ok := s.Store.ReadAll(table)
+	if !ok {
+		return nil, false
+	}
+	for key, value := range values {
+		value, err := s.decrypt(table, key, value)
+		if err != nil {
+			s.fail("read", table, key, err)
+			delete(values, key)
+			continue
+		}
+		values[key] = value
+	}
+	return values, true
+}
+
+func (s *cryptStore) Size(table, key string) (int64, bool) {
+	if !cryptIsStream(table) {
+		value, ok := s.Read(table, key)
+		return int64(len(value)), ok
+	}
+	size, ok := s.Store.Size(table, key)
+	if !ok {
+		return 0, false
+	}
+	header, ok := s.streamHeader(table, key)
+	if !ok {
+		return 0, false
+	}
+	if header == nil {
+		return size, true
+	}
+	return size - int64(cryptStreamHeaderSize), true
+}
+
+func (s *cryptStore) ReadRange(table, key string, offset int64, length int) ([]byte, bool) {
+	if !cryptIsStream(table) {
+		value, ok := s.Read(table, key)
+		if !ok {
+			return nil, false
+		}
+		return readRange(bytes.NewReader(value), offset, length)
+	}
+	header, ok := s.streamHeader(table, key)
+	if !ok {
+		return nil, false
+	}
+	if header == nil {
+		return s.Store.ReadRange(table, key, offset, length)
+	}
+	if offset < 0 {
+		return nil, false
+	}
+	block, err := s.streamBlock(table, key, header)
+	if err != nil {
+		s.fail("read", table, key, err)
+		return nil, false
+	}
+	data, ok := s.Store.ReadRange(table, key, int64(cryptStreamHeaderSize)+offset, length)
+	if !ok {
+		return nil, false
+	}
+	cryptStream(block, header[cryptWrapSize:], offset).XORKeyStream(data, data)
+	return data, true
+}
+
+func (s *cryptStore) ReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	data, ok := s.Read(table, key)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	return readEntries(bytes.NewReader(data), offset, whence, total)
+}
+
+// encryptAll encrypts every plain text value and rewraps the data keys of
+// values encrypted with an old key. It returns the number of values changed.
+func (s *cryptStore) encryptAll(tables []string) (encrypted, rewrapped int, err error) {
+	for _, table := range tables {
+		keys, _ := s.Store.Keys(table)
+		for _, key := range keys {
+			changed, wasPlain, err := s.encryptValue(table, key)
+			if err != nil {
+				return encrypted, rewrapped, fmt.Errorf("%s/%s: %w", table, key, err)
+			}
+			if changed && wasPlain {
+				encrypted++
+			} else if changed {
+				rewrapped++
+			}
+		}
+	}
+	return encrypted, rewrapped, nil
+}
+
+// encryptValue encrypts a plain text value or rewraps the data key of a
+// value encrypted with an old key.
+func (s *cryptStore) encryptValue(table, key string) (changed, wasPlain bool, err error) {
+	defer s.lock(table, key).Unlock()
+	value, ok := s.Store.Read(table, key)
+	if !ok {
+		return false, false, nil
+	}
+	if !cryptIsEncrypted(value) {
+		if !s.write(table, key, value) {
+			return false, true, errors.New("write failed")
+		}
+		return true, true, nil
+	}
+	if len(value) < cryptWrapSize {
+		return false, false, errors.New("encrypted value is too short")
+	}
+	if bytes.Equal(value[len(cryptMagic)+1:len(cryptMagic)+1+cryptKeyIdSize], s.keyring.keys[0].id) {
+		return false, false, nil
+	}
+	if value, err = s.rewrap(table, key, value); err != nil {
+		return false, false, err
+	}
+	if !s.Store.Write(table, key, value) {
+		return false, false, errors.New("write failed")
+	}
+	return true, false, nil
+}
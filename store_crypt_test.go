@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeyring loads a keyring from base64 encoded keys like
+// DB_ENCRYPTION_KEY.
+func testKeyring(t *testing.T, keys ...string) *cryptKeyring {
+	t.Helper()
+	defer func(key, file string) { DbEncryptionKey, DbEncryptionKeyFile = key, file }(DbEncryptionKey, DbEncryptionKeyFile)
+	DbEncryptionKey, DbEncryptionKeyFile = strings.Join(keys, ","), ""
+	keyring, err := cryptLoadKeyring()
+	if err != nil || keyring == nil {
+		t.Fatalf("cryptLoadKeyring = %v, %v", keyring, err)
+	}
+	return keyring
+}
+
+func testCryptKey() string {
+	key := make([]byte, cryptKeySize)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// testCryptStore returns an encrypted memory store and the store under it.
+func testCryptStore(t *testing.T, keys ...string) (*cryptStore, Store) {
+	t.Helper()
+	raw := newMemStore()
+	s := newCryptStore(raw, testKeyring(t, keys...))
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	return s, raw
+}
+
+func TestCryptStreamAppend(t *testing.T) {
+	s, raw := testCryptStore(t, testCryptKey())
+	plain := []byte{}
+	// Appends that start and end in the middle of AES blocks
+	for i, n := range []int{5, 17, 3, 40, 16, 1, 31} {
+		chunk := bytes.Repeat([]byte{byte('a' + i)}, n)
+		if !s.Append("chat_messages", "global", chunk) {
+			t.Fatalf("append %d failed", i)
+		}
+		plain = append(plain, chunk...)
+	}
+
+	stored, _ := raw.Read("chat_messages", "global")
+	if !cryptIsEncrypted(stored) || bytes.Contains(stored, []byte("ccc")) {
+		t.Fatal("stored value isn't encrypted")
+	}
+	if value, ok := s.Read("chat_messages", "global"); !ok || !bytes.Equal(value, plain) {
+		t.Fatalf("Read = %q, %v, want %q", value, ok, plain)
+	}
+	if size, ok := s.Size("chat_messages", "global"); !ok || size != int64(len(plain)) {
+		t.Errorf("Size = %d, %v, want %d", size, ok, len(plain))
+	}
+	for offset := 0; offset <= len(plain); offset++ {
+		for _, length := range []int{0, 1, 15, 16, 17, 100} {
+			want := plain[offset:min(offset+length, len(plain))]
+			if got, ok := s.ReadRange("chat_messages", "global", int64(offset), length); !ok || !bytes.Equal(got, want) {
+				t.Fatalf("ReadRange(%d, %d) = %q, %v, want %q", offset, length, got, ok, want)
+			}
+		}
+	}
+}
+
+func TestCryptRotate(t *testing.T) {
+	oldKey, newKey := testCryptKey(), testCryptKey()
+	s, raw := testCryptStore(t, oldKey)
+	s.Write("settings", "user", []byte(`{"theme":"dark"}`))
+	s.Append("chat_messages", "global", []byte("line 1\n"))
+
+	// The old key is only kept to read values written with it
+	s = newCryptStore(raw, testKeyring(t, newKey, oldKey))
+	s.Append("chat_messages", "global", []byte("line 2\n"))
+	encrypted, rewrapped, err := s.encryptAll(dbTables)
+	if err != nil || encrypted != 0 || rewrapped != 2 {
+		t.Fatalf("encryptAll = %d, %d, %v, want 0, 2, nil", encrypted, rewrapped, err)
+	}
+	if encrypted, rewrapped, err := s.encryptAll(dbTables); err != nil || encrypted != 0 || rewrapped != 0 {
+		t.Errorf("second encryptAll = %d, %d, %v, want 0, 0, nil", encrypted, rewrapped, err)
+	}
+
+	s = newCryptStore(raw, testKeyring(t, newKey))
+	if value, ok := s.Read("settings", "user"); !ok || string(value) != `{"theme":"dark"}` {
+		t.Errorf("settings = %q, %v after rotation", value, ok)
+	}
+	if value, ok := s.Read("chat_messages", "global"); !ok || string(value) != "line 1\nline 2\n" {
+		t.Errorf("chat log = %q, %v after rotation", value, ok)
+	}
+	s = newCryptStore(raw, testKeyring(t, oldKey))
+	if _, ok := s.Read("settings", "user"); ok {
+		t.Error("value can still be read with the old key")
+	}
+}
+
+func TestCryptRecoversTornLog(t *testing.T) {
+	dir := t.TempDir()
+	key := testCryptKey()
+	s := newCryptStore(newFileStore(dir), testKeyring(t, key))
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	s.Append("chat_messages", "global", []byte("line 1\n"))
+	s.Append("chat_messages", "global", []byte("torn"))
+	s.Close()
+
+	s = newCryptStore(newFileStore(dir), testKeyring(t, key))
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, ok := s.Read("chat_messages", "global"); !ok || string(value) != "line 1\n" {
+		t.Fatalf("recovered log = %q, %v, want %q", value, ok, "line 1\n")
+	}
+	s.Append("chat_messages", "global", []byte("line 2\n"))
+	if value, ok := s.Read("chat_messages", "global"); !ok || string(value) != "line 1\nline 2\n" {
+		t.Errorf("log after append = %q, %v", value, ok)
+	}
+}
+
+func TestCryptReadsPlainText(t *testing.T) {
+	raw := newMemStore()
+	raw.Init(dbTables)
+	raw.Write("settings", "user", []byte(`{"theme":"dark"}`))
+	raw.Write("chat_messages", "global", []byte("line 1\n"))
+
+	s := newCryptStore(raw, testKeyring(t, testCryptKey()))
+	if value, ok := s.Read("settings", "user"); !ok || string(value) != `{"theme":"dark"}` {
+		t.Errorf("plain settings = %q, %v", value, ok)
+	}
+	// Appending to a plain log keeps it plain
+	s.Append("chat_messages", "global", []byte("line 2\n"))
+	if stored, _ := raw.Read("chat_messages", "global"); string(stored) != "line 1\nline 2\n" {
+		t.Errorf("plain log is stored as %q", stored)
+	}
+	if value, ok := s.ReadRange("chat_messages", "global", 3, 8); !ok || string(value) != "e 1\nline" {
+		t.Errorf("ReadRange of plain log = %q, %v", value, ok)
+	}
+
+	encrypted, rewrapped, err := s.encryptAll(dbTables)
+	if err != nil || encrypted != 2 || rewrapped != 0 {
+		t.Fatalf("encryptAll = %d, %d, %v, want 2, 0, nil", encrypted, rewrapped, err)
+	}
+	for _, table := range []string{"settings", "chat_messages"} {
+		key := map[string]string{"settings": "user", "chat_messages": "global"}[table]
+		if stored, _ := raw.Read(table, key); !cryptIsEncrypted(stored) {
+			t.Errorf("%s is still plain text", table)
+		}
+	}
+	if value, ok := s.Read("chat_messages", "global"); !ok || string(value) != "line 1\nline 2\n" {
+		t.Errorf("encrypted log = %q, %v", value, ok)
+	}
+}
+
+// slowAppendStore gives other goroutines time to run in the middle of an
+// append.
+type slowAppendStore struct {
+	Store
+}
+
+func (s slowAppendStore) Append(table, key string, value []byte) bool {
+	time.Sleep(100 * time.Microsecond)
+	return s.Store.Append(table, key, value)
+}
+
+// TestCryptConcurrentWriteAppend rewrites a log while it is appended to, like
+// an index rebuild racing a new message. Run it with -race.
+func TestCryptConcurrentWriteAppend(t *testing.T) {
+	raw := newMemStore()
+	raw.Init(dbTables)
+	s := newCryptStore(slowAppendStore{raw}, testKeyring(t, testCryptKey()))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				line := []byte(fmt.Sprintf("worker %d line %d\n", w, i))
+				if w == 0 && i%3 == 0 {
+					s.Write("chat_index", "global", line)
+				} else {
+					s.Append("chat_index", "global", line)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	value, ok := s.Read("chat_index", "global")
+	if !ok {
+		t.Fatal("Read failed")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(value), "\n"), "\n") {
+		var w, i int
+		if n, err := fmt.Sscanf(line, "worker %d line %d", &w, &i); n != 2 || err != nil {
+			t.Fatalf("garbled line %q", line)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var dbPerm fs.FileMode = 0700
+
+// fileStore keeps each table in its own directory with one file per key.
+//
+// Writes go to a temporary file which is fsynced and then renamed over the
+// old value, so a crash leaves either the old or the new value but never a
+// truncated one.
+//
+// Writes to the same key are serialized by a striped set of locks so that
+// Update and Create can read and write a key without racing other writers.
+type fileStore struct {
+	dir   string
+	sync  string
+	locks [256]sync.Mutex
+	// Releases the lock on the data directory taken by Init
+	unlock func()
+}
+
+func newFileStore(dir string) *fileStore {
+	return &fileStore{dir: dir, sync: DbSync}
+}
+
+func (s *fileStore) Init(tables []string) (err error) {
+	if err := os.MkdirAll(s.dir, dbPerm); err != nil {
+		return err
+	}
+	s.unlock, err = lockDataDir(s.dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.unlock()
+		}
+	}()
+	for _, table := range tables {
+		if err := os.Mkdir(s.tablePath(table), dbPerm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	// Anything left in the temp directory is from a write that never finished
+	os.RemoveAll(s.tmpPath())
+	if err := os.Mkdir(s.tmpPath(), dbPerm); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if dbIsLogTable(table) {
+			s.recoverLogs(table)
+		}
+	}
+	return nil
+}
+
+// recoverLogs truncates a torn trailing line left in an append-only log by a
+// crash in the middle of Append.
+func (s *fileStore) recoverLogs(table string) {
+	files, err := os.ReadDir(s.tablePath(table))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		path := s.path(table, file.Name())
+		size, ok := completeLinesSize(path)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == size {
+			continue
+		}
+		if err := os.Truncate(path, size); err != nil {
+			myslog.Error("recover log", "table", table, "key", file.Name(), "err", err)
+			continue
+		}
+		myslog.Warn("recover log", "table", table, "key", file.Name(), "truncatedBytes", info.Size()-size)
+	}
+}
+
+// completeLinesSize returns the size of a file up to and including its last newline.
+func completeLinesSize(path string) (size int64, ok bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	// Lines of encrypted logs can't be seen here, see cryptStore.Init
+	magic := make([]byte, len(cryptMagic))
+	if _, err := file.ReadAt(magic, 0); err == nil && cryptIsEncrypted(magic) {
+		return 0, false
+	}
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return 0, false
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return end - n + int64(i) + 1, true
+		}
+		end -= n
+	}
+	return 0, true
+}
+
+func (s *fileStore) tmpPath() string {
+	return s.dir + "/.tmp"
+}
+
+func (s *fileStore) tablePath(table string) string {
+	return s.dir + "/" + table
+}
+
+func (s *fileStore) path(table, key string) string {
+	return s.tablePath(table) + "/" + key
+}
+
+func (s *fileStore) Read(table, key string) (value []byte, ok bool) {
+	value, err := os.ReadFile(s.path(table, key))
+	return value, err == nil
+}
+
+func (s *fileStore) Exists(table, key string) bool {
+	_, err := os.Stat(s.path(table, key))
+	return err == nil
+}
+
+func (s *fileStore) ReadAll(table string) (values map[string]([]byte), ok bool) {
+	files, err := os.ReadDir(s.tablePath(table))
+	if err != nil {
+		return nil, false
+	}
+
+	values = map[string]([]byte){}
+
+	for _, file := range files {
+		values[file.Name()], ok = s.Read(table, file.Name())
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+func (s *fileStore) Keys(table string) (keys []string, ok bool) {
+	files, err := os.ReadDir(s.tablePath(table))
+	if err != nil {
+		return nil, false
+	}
+	keys = make([]string, len(files))
+	for i, file := range files {
+		keys[i] = file.Name()
+	}
+	return keys, true
+}
+
+func (s *fileStore) Size(table, key string) (size int64, ok bool) {
+	info, err := os.Stat(s.path(table, key))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+func (s *fileStore) ReadRange(table, key string, offset int64, length int) (value []byte, ok bool) {
+	file, err := os.Open(s.path(table, key))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	return readRange(file, offset, length)
+}
+
+func (s *fileStore) ReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	file, err := os.OpenFile(s.path(table, key), os.O_RDONLY, dbPerm)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	defer file.Close()
+	return readEntries(file, offset, whence, total)
+}
+
+func (s *fileStore) lock(table, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(table))
+	h.Write([]byte{'/'})
+	h.Write([]byte(key))
+	l := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	l.Lock()
+	return l
+}
+
+func (s *fileStore) Write(table, key string, value []byte) bool {
+	defer s.lock(table, key).Unlock()
+	return s.write(table, key, value)
+}
+
+func (s *fileStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	defer s.lock(table, key).Unlock()
+	value, write := fn(s.Read(table, key))
+	if !write {
+		return false
+	}
+	return s.write(table, key, value)
+}
+
+func (s *fileStore) Create(table, key string, value []byte) bool {
+	defer s.lock(table, key).Unlock()
+	if s.Exists(table, key) {
+		return false
+	}
+	return s.write(table, key, value)
+}
+
+func (s *fileStore) write(table, key string, value []byte) bool {
+	file, err := os.CreateTemp(s.tmpPath(), table+"-*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(value)
+	if err == nil && s.sync != "off" {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false
+	}
+	path := s.path(table, key)
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false
+	}
+	if s.sync == "full" {
+		return syncDir(filepath.Dir(path)) == nil
+	}
+	return true
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *fileStore) Append(table, key string, value []byte) bool {
+	file, err := os.OpenFile(s.path(table, key), os.O_APPEND|os.O_CREATE|os.O_WRONLY, dbPerm)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if _, err := file.Write(value); err != nil {
+		return false
+	}
+	if s.sync == "full" {
+		return file.Sync() == nil
+	}
+	return true
+}
+
+func (s *fileStore) Delete(table, key string) bool {
+	defer s.lock(table, key).Unlock()
+	return os.Remove(s.path(table, key)) == nil
+}
+
+func (s *fileStore) Close() error {
+	if s.unlock != nil {
+		s.unlock()
+	}
+	return nil
+}
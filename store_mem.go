@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// memStore keeps every table in memory. Nothing is persisted, which makes it
+// useful for tests and throwaway instances.
+type memStore struct {
+	mu     sync.RWMutex
+	tables map[string]map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{tables: map[string]map[string][]byte{}}
+}
+
+func (s *memStore) Init(tables []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, table := range tables {
+		if _, ok := s.tables[table]; !ok {
+			s.tables[table] = map[string][]byte{}
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Read(table, key string) (value []byte, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok = s.tables[table][key]
+	return bytes.Clone(value), ok
+}
+
+func (s *memStore) Exists(table, key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.tables[table][key]
+	return ok
+}
+
+func (s *memStore) ReadAll(table string) (values map[string]([]byte), ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return nil, false
+	}
+	values = map[string]([]byte){}
+	for key, value := range t {
+		values[key] = bytes.Clone(value)
+	}
+	return values, true
+}
+
+func (s *memStore) Keys(table string) (keys []string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return nil, false
+	}
+	keys = make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+func (s *memStore) Size(table, key string) (size int64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.tables[table][key]
+	return int64(len(value)), ok
+}
+
+func (s *memStore) ReadRange(table, key string, offset int64, length int) (value []byte, ok bool) {
+	s.mu.RLock()
+	data, ok := s.tables[table][key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return readRange(bytes.NewReader(data), offset, length)
+}
+
+func (s *memStore) ReadEntries(table, key string, offset int64, whence int, total int) (value []byte, newOffset int64, newTotal int, ok bool) {
+	s.mu.RLock()
+	data, ok := s.tables[table][key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, 0, 0, false
+	}
+	// Appends never modify data in place, so it is safe to read without the lock
+	return readEntries(bytes.NewReader(data), offset, whence, total)
+}
+
+func (s *memStore) Write(table, key string, value []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return false
+	}
+	t[key] = bytes.Clone(value)
+	return true
+}
+
+func (s *memStore) Update(table, key string, fn func(value []byte, ok bool) (newValue []byte, write bool)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return false
+	}
+	value, ok := t[key]
+	value, write := fn(bytes.Clone(value), ok)
+	if !write {
+		return false
+	}
+	t[key] = bytes.Clone(value)
+	return true
+}
+
+func (s *memStore) Create(table, key string, value []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return false
+	}
+	if _, ok := t[key]; ok {
+		return false
+	}
+	t[key] = bytes.Clone(value)
+	return true
+}
+
+func (s *memStore) Append(table, key string, value []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[table]
+	if !ok {
+		return false
+	}
+	t[key] = append(t[key], value...)
+	return true
+}
+
+func (s *memStore) Delete(table, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tables[table][key]
+	delete(s.tables[table], key)
+	return ok
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testStore opens a store of a backend in a new directory.
+func testStore(t *testing.T, backend string) Store {
+	t.Helper()
+	s, err := openStore(backend, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreValues(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := testStore(t, backend)
+			if _, ok := s.Read("settings", "a"); ok || s.Exists("settings", "a") {
+				t.Fatal("missing key exists")
+			}
+			if !s.Write("settings", "a", []byte("1")) || !s.Create("settings", "b", []byte("2")) {
+				t.Fatal("Write or Create failed")
+			}
+			if s.Create("settings", "a", []byte("3")) {
+				t.Error("Create replaced a value")
+			}
+			if value, ok := s.Read("settings", "a"); !ok || string(value) != "1" || !s.Exists("settings", "a") {
+				t.Errorf("Read = %q, %v, want 1", value, ok)
+			}
+			if size, ok := s.Size("settings", "b"); !ok || size != 1 {
+				t.Errorf("Size = %d, %v, want 1", size, ok)
+			}
+
+			ok := s.Update("settings", "a", func(value []byte, ok bool) ([]byte, bool) {
+				return append(value, '0'), ok
+			})
+			if value, _ := s.Read("settings", "a"); !ok || string(value) != "10" {
+				t.Errorf("Update = %v and wrote %q, want 10", ok, value)
+			}
+			if s.Update("settings", "c", func(value []byte, ok bool) ([]byte, bool) { return []byte("c"), ok }) || s.Exists("settings", "c") {
+				t.Error("Update wrote a missing key it refused to write")
+			}
+
+			keys, _ := s.Keys("settings")
+			sort.Strings(keys)
+			values, _ := s.ReadAll("settings")
+			if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" || len(values) != 2 || string(values["b"]) != "2" {
+				t.Errorf("Keys = %q, ReadAll = %q", keys, values)
+			}
+
+			if !s.Delete("settings", "a") || s.Exists("settings", "a") {
+				t.Error("Delete failed")
+			}
+			if s.Delete("settings", "a") {
+				t.Error("Delete of a missing key reported it existed")
+			}
+		})
+	}
+}
+
+func TestStoreLogs(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := testStore(t, backend)
+			want := []byte{}
+			for _, line := range []string{`{"n":1}`, `{"n":22}`, `{"n":333}`, `{"n":4444}`} {
+				if !s.Append("chat_messages", "global", []byte(line+"\n")) {
+					t.Fatal("Append failed")
+				}
+				want = append(want, line+"\n"...)
+			}
+			if value, ok := s.Read("chat_messages", "global"); !ok || !bytes.Equal(value, want) {
+				t.Fatalf("Read = %q, %v, want %q", value, ok, want)
+			}
+			if size, ok := s.Size("chat_messages", "global"); !ok || size != int64(len(want)) {
+				t.Errorf("Size = %d, %v, want %d", size, ok, len(want))
+			}
+			for offset := 0; offset <= len(want)+1; offset++ {
+				for _, length := range []int{0, 1, 7, 100} {
+					expected, _ := readRange(bytes.NewReader(want), int64(offset), length)
+					if got, ok := s.ReadRange("chat_messages", "global", int64(offset), length); !ok || !bytes.Equal(got, expected) {
+						t.Fatalf("ReadRange(%d, %d) = %q, %v, want %q", offset, length, got, ok, expected)
+					}
+				}
+			}
+			for _, test := range []struct {
+				offset int64
+				whence int
+				total  int
+			}{
+				{0, io.SeekStart, 10}, {3, io.SeekStart, 10}, {8, io.SeekStart, 2},
+				{0, io.SeekEnd, 10}, {-10, io.SeekEnd, 10}, {-1000, io.SeekEnd, 10},
+			} {
+				value, offset, total, ok := s.ReadEntries("chat_messages", "global", test.offset, test.whence, test.total)
+				wantValue, wantOffset, wantTotal, _ := readEntries(bytes.NewReader(want), test.offset, test.whence, test.total)
+				if !ok || !bytes.Equal(value, wantValue) || offset != wantOffset || total != wantTotal {
+					t.Errorf("ReadEntries(%d, %d, %d) = %q, %d, %d, %v, want %q, %d, %d", test.offset, test.whence, test.total,
+						value, offset, total, ok, wantValue, wantOffset, wantTotal)
+				}
+			}
+
+			// A value that was written is appended to as it is
+			s.Write("chat_messages", "plain", []byte("line 1\n"))
+			s.Append("chat_messages", "plain", []byte("line 2\n"))
+			if value, _ := s.Read("chat_messages", "plain"); string(value) != "line 1\nline 2\n" {
+				t.Errorf("appending to a written value gave %q", value)
+			}
+			if value, ok := s.ReadRange("chat_messages", "plain", 5, 4); !ok || string(value) != "1\nli" {
+				t.Errorf("ReadRange across the written value = %q, %v", value, ok)
+			}
+
+			// Writing a log replaces it
+			s.Write("chat_messages", "global", []byte("new\n"))
+			s.Append("chat_messages", "global", []byte("next\n"))
+			if value, _ := s.Read("chat_messages", "global"); string(value) != "new\nnext\n" {
+				t.Errorf("log after Write and Append = %q", value)
+			}
+			if !s.Delete("chat_messages", "global") || s.Exists("chat_messages", "global") {
+				t.Error("Delete of a log failed")
+			}
+		})
+	}
+}
+
+// TestBoltLogReader reads a log made of chunks of different sizes at every
+// offset, and checks it against a bytes.Reader.
+func TestBoltLogReader(t *testing.T) {
+	s := newBoltStore(t.TempDir())
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	want := []byte{}
+	for i, n := range []int{1, 5, 1, 16, 3, 40, 2} {
+		chunk := bytes.Repeat([]byte{byte('a' + i)}, n)
+		s.Append("chat_messages", "global", chunk)
+		want = append(want, chunk...)
+	}
+
+	s.bolt.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket([]byte("chat_messages")).Bucket([]byte("global"))
+		if log == nil {
+			t.Fatal("log isn't stored as chunks")
+		}
+		if size := boltLogSize(log); size != int64(len(want)) {
+			t.Errorf("boltLogSize = %d, want %d", size, len(want))
+		}
+		r := newBoltLogReader(log)
+		for offset := 0; offset <= len(want)+1; offset++ {
+			for _, length := range []int{1, 2, 5, 17, 100} {
+				got := make([]byte, length)
+				n, err := r.ReadAt(got, int64(offset))
+				wantN, wantErr := bytes.NewReader(want).ReadAt(make([]byte, length), int64(offset))
+				if n != wantN || !bytes.Equal(got[:n], want[min(offset, len(want)):min(offset, len(want))+n]) || err != wantErr {
+					t.Fatalf("ReadAt at %d of %d bytes = %q, %v, want %d bytes, %v", offset, length, got[:n], err, wantN, wantErr)
+				}
+			}
+		}
+
+		for _, test := range []struct {
+			offset int64
+			whence int
+			want   int64
+		}{
+			{0, io.SeekStart, 0}, {10, io.SeekStart, 10}, {5, io.SeekCurrent, 15}, {-3, io.SeekCurrent, 12},
+			{0, io.SeekEnd, int64(len(want))}, {-1, io.SeekEnd, int64(len(want)) - 1}, {100, io.SeekStart, 100},
+		} {
+			if pos, err := r.Seek(test.offset, test.whence); err != nil || pos != test.want {
+				t.Errorf("Seek(%d, %d) = %d, %v, want %d", test.offset, test.whence, pos, err, test.want)
+			}
+		}
+		if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Read past the end = %d, %v, want io.EOF", n, err)
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err == nil {
+			t.Error("Seek to a negative position succeeded")
+		}
+		if _, err := r.Seek(0, 3); err == nil {
+			t.Error("Seek with an invalid whence succeeded")
+		}
+		r.Seek(int64(len(want))-2, io.SeekStart)
+		if rest, err := io.ReadAll(r); err != nil || !bytes.Equal(rest, want[len(want)-2:]) {
+			t.Errorf("reading the last chunk = %q, %v", rest, err)
+		}
+		return nil
+	})
+}
+
+// testFileLayout writes a data directory in the layout of the file backend.
+func testFileLayout(t *testing.T, dir string) {
+	t.Helper()
+	files := newFileStore(dir)
+	if err := files.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	files.Write("user", "user", []byte(`{"username":"user"}`))
+	files.Write("settings", "user", []byte(`{}`))
+	files.Append("chat_messages", "global", []byte("line 1\n"))
+	files.Append("chat_messages", "global", []byte("line 2\n"))
+	files.Close()
+}
+
+func TestBoltMigrateFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	testFileLayout(t, dir)
+	s := newBoltStore(dir)
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, _ := s.Read("user", "user"); string(value) != `{"username":"user"}` {
+		t.Errorf("user = %q", value)
+	}
+	if value, _ := s.Read("settings", "user"); string(value) != `{}` {
+		t.Errorf("settings = %q", value)
+	}
+	if value, _ := s.Read("chat_messages", "global"); string(value) != "line 1\nline 2\n" {
+		t.Errorf("chat log = %q", value)
+	}
+	// Logs are imported as chunks that can be appended to
+	s.Append("chat_messages", "global", []byte("line 3\n"))
+	if value, ok := s.ReadRange("chat_messages", "global", 7, 14); !ok || string(value) != "line 2\nline 3\n" {
+		t.Errorf("ReadRange after import = %q, %v", value, ok)
+	}
+}
+
+func TestBoltMigrateFromFilesRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	testFileLayout(t, dir)
+	// A table that can't be read fails the import
+	if err := os.Mkdir(dir+"/settings/broken", dbPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBoltStore(dir).Init(dbTables); err == nil {
+		t.Fatal("Init succeeded with an unreadable table")
+	}
+	if _, err := os.Stat(dir + "/harmon.db"); !os.IsNotExist(err) {
+		t.Errorf("database file was left behind: %v", err)
+	}
+
+	// Nothing was half imported, so the next start imports everything
+	os.Remove(dir + "/settings/broken")
+	s := newBoltStore(dir)
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, _ := s.Read("settings", "user"); string(value) != `{}` {
+		t.Errorf("settings = %q after a retried import", value)
+	}
+}
+
+// TestFileRecoversTornLog checks that Init truncates a line left half written
+// by a crash, so that the next append starts a line of its own.
+func TestFileRecoversTornLog(t *testing.T) {
+	dir := t.TempDir()
+	s := newFileStore(dir)
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	s.Append("chat_messages", "global", []byte(`{"n":1}`+"\n"))
+	s.Append("chat_messages", "global", []byte(`{"n":`))
+	// Values of other tables aren't logs and are left alone
+	s.Write("settings", "user", []byte(`{"n":`))
+	s.Close()
+
+	s = newFileStore(dir)
+	if err := s.Init(dbTables); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, _ := s.Read("chat_messages", "global"); string(value) != `{"n":1}`+"\n" {
+		t.Fatalf("recovered log = %q", value)
+	}
+	if value, _ := s.Read("settings", "user"); string(value) != `{"n":` {
+		t.Errorf("settings = %q after recovery", value)
+	}
+	s.Append("chat_messages", "global", []byte(`{"n":2}`+"\n"))
+	if value, _ := s.Read("chat_messages", "global"); string(value) != `{"n":1}`+"\n"+`{"n":2}`+"\n" {
+		t.Errorf("log after append = %q", value)
+	}
+
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Users can turn on two-factor authentication with an authenticator app
+// (RFC 6238 TOTP). Once it is enabled, /login also needs a code from the app
+// or one of the recovery codes that were handed out at enrollment. Enrollments
+// are kept in the totp table, keyed by user id.
+type Totp struct {
+	// Base32 without padding, as in the provisioning URI
+	Secret string `json:"secret"`
+	// Set once the user has confirmed the enrollment with a code
+	Enabled bool `json:"enabled"`
+	// Hashes of the recovery codes that haven't been used
+	RecoveryCodes []string `json:"recoveryCodes"`
+	// The time step of the last code used, so that a code can't be replayed
+	LastStep int64 `json:"lastStep"`
+	Created  int64 `json:"created"`
+}
+
+const (
+	totpIssuer = "Harmon"
+	totpPeriod = 30
+	totpDigits = 6
+	// Number of time steps before and after the current one whose codes
+	// are accepted, to allow for clock drift
+	totpSkew          = 1
+	totpRecoveryCodes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code of a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%uint32(math.Pow10(totpDigits)))
+}
+
+// use checks a code against the enrollment and, if it is valid, marks it used.
+// Recovery codes are only accepted once the enrollment is enabled.
+func (t *Totp) use(code string, now time.Time) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if code == "" {
+		return false
+	}
+	secret, err := totpEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > t.LastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			t.LastStep = step
+			return true
+		}
+	}
+	if !t.Enabled {
+		return false
+	}
+	hash := hashToken(code)
+	for i, recoveryCode := range t.RecoveryCodes {
+		if hmac.Equal([]byte(recoveryCode), []byte(hash)) {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// totpEnabled reports whether a user has two-factor authentication enabled.
+func totpEnabled(userId string) bool {
+	text, ok := dbRead("totp", userId)
+	t := Totp{}
+	return ok && json.Unmarshal(text, &t) == nil && t.Enabled
+}
+
+// totpEnroll starts enrolling a user, replacing an enrollment that wasn't
+// confirmed, and returns the provisioning URI for the authenticator app and the
+// recovery codes. It fails if two-factor authentication is already enabled.
+func totpEnroll(userId, username string) (uri string, recoveryCodes []string, ok bool) {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	t := Totp{Secret: totpEncoding.EncodeToString(secret), Created: time.Now().UnixMilli()}
+	for i := 0; i < totpRecoveryCodes; i++ {
+		code := randomString(10)
+		recoveryCodes = append(recoveryCodes, code)
+		t.RecoveryCodes = append(t.RecoveryCodes, hashToken(code))
+	}
+	ok = dbUpdate("totp", userId, func(text []byte, ok bool) ([]byte, bool) {
+		current := Totp{}
+		if ok && json.Unmarshal(text, &current) == nil && current.Enabled {
+			return nil, false
+		}
+		text, _ = json.Marshal(t)
+		return text, true
+	})
+	if !ok {
+		return "", nil, false
+	}
+	query := url.Values{}
+	query.Set("secret", t.Secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri = "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + query.Encode()
+	return uri, recoveryCodes, true
+}
+
+// totpConfirm enables a user's pending enrollment if code is a valid code from
+// the authenticator app.
+func totpConfirm(userId, code string) bool {
+	return dbUpdate("totp", userId, func(text []byte, ok bool) ([]byte, bool) {
+		t := Totp{}
+		if !ok || json.Unmarshal(text, &t) != nil || t.Enabled || !t.use(code, time.Now()) {
+			return nil, false
+		}
+		t.Enabled = true
+		text, _ = json.Marshal(t)
+		return text, true
+	})
+}
+
+// totpCheck reports whether code is a valid code or recovery code of a user
+// with two-factor authentication enabled, and uses it up.
+func totpCheck(userId, code string) bool {
+	return dbUpdate("totp", userId, func(text []byte, ok bool) ([]byte, bool) {
+		t := Totp{}
+		if !ok || json.Unmarshal(text, &t) != nil || !t.Enabled || !t.use(code, time.Now()) {
+			return nil, false
+		}
+		text, _ = json.Marshal(t)
+		return text, true
+	})
+}
+
+// totpReset turns off two-factor authentication for a user.
+func totpReset(userId string) {
+	dbDelete("totp", userId)
+}
+
+// totpCommand runs the totp command: "reset <username>" turns off two-factor
+// authentication for a user who lost their authenticator app and recovery
+// codes.
+func totpCommand(args []string) bool {
+	if len(args) != 2 || args[0] != "reset" || !dbValidKey(args[1]) {
+		myslog.Error("usage: totp reset <username>")
+		return false
+	}
+	value, ok := dbRead("username_to_user_id", args[1])
+	if !ok {
+		myslog.Error("no such user", "username", args[1])
+		return false
+	}
+	totpReset(string(value))
+	myslog.Info("totp reset", "userId", string(value))
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogin posts body to /login.
+func testLogin(t *testing.T, body LoginRequestBody) *httptest.ResponseRecorder {
+	t.Helper()
+	return testLoginFrom(t, "192.0.2.1", body)
+}
+
+// testLoginFrom posts body to /login from an IP address.
+func testLoginFrom(t *testing.T, ip string, body LoginRequestBody) *httptest.ResponseRecorder {
+	t.Helper()
+	text, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(string(text)))
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	serveHome(nil, w, r)
+	return w
+}
+
+// testTotpSecret returns the secret of a user's enrollment.
+func testTotpSecret(t *testing.T, userId string) []byte {
+	t.Helper()
+	text, _ := dbRead("totp", userId)
+	totp := Totp{}
+	json.Unmarshal(text, &totp)
+	secret, err := totpEncoding.DecodeString(totp.Secret)
+	if err != nil {
+		t.Fatalf("enrollment has secret %q: %v", totp.Secret, err)
+	}
+	return secret
+}
+
+// testTotpEnable enrolls a user and confirms the enrollment with the code of
+// the previous time step, so that the current one can still be used. It
+// returns the secret and recovery codes.
+func testTotpEnable(t *testing.T, userId string) ([]byte, []string) {
+	t.Helper()
+	_, recoveryCodes, ok := totpEnroll(userId, "user")
+	if !ok {
+		t.Fatal("totpEnroll failed")
+	}
+	secret := testTotpSecret(t, userId)
+	if !totpConfirm(userId, totpCode(secret, time.Now().Unix()/totpPeriod-1)) {
+		t.Fatal("totpConfirm failed")
+	}
+	return secret, recoveryCodes
+}
+
+// TestTotpCode checks codes against the SHA-1 test vectors of RFC 6238, of
+// which only the last six digits are used.
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, test := range []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(secret, test.time/totpPeriod); got != test.want {
+			t.Errorf("code at %d = %s, want %s", test.time, got, test.want)
+		}
+	}
+}
+
+func TestTotpReplay(t *testing.T) {
+	testDbInit(t, "memory")
+	secret, _ := testTotpEnable(t, "user")
+	step := time.Now().Unix() / totpPeriod
+	if !totpCheck("user", totpCode(secret, step)) {
+		t.Fatal("current code refused")
+	}
+	if totpCheck("user", totpCode(secret, step)) {
+		t.Error("current code accepted twice")
+	}
+	// Codes of earlier steps can't be used once a later one has been
+	if totpCheck("user", totpCode(secret, step-1)) {
+		t.Error("code of the previous step accepted after the current one")
+	}
+	text, _ := dbRead("totp", "user")
+	totp := Totp{}
+	if json.Unmarshal(text, &totp); totp.LastStep != step {
+		t.Errorf("LastStep = %d, want %d", totp.LastStep, step)
+	}
+}
+
+func TestTotpRecoveryCodes(t *testing.T) {
+	testDbInit(t, "memory")
+	_, recoveryCodes, ok := totpEnroll("user", "user")
+	if !ok || len(recoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("totpEnroll = %d recovery codes, %v", len(recoveryCodes), ok)
+	}
+	// Recovery codes can't confirm an enrollment
+	if totpConfirm("user", recoveryCodes[0]) {
+		t.Fatal("enrollment confirmed with a recovery code")
+	}
+	secret := testTotpSecret(t, "user")
+	if !totpConfirm("user", totpCode(secret, time.Now().Unix()/totpPeriod)) {
+		t.Fatal("totpConfirm failed")
+	}
+
+	if !totpCheck("user", recoveryCodes[0]) {
+		t.Fatal("recovery code refused")
+	}
+	if totpCheck("user", recoveryCodes[0]) {
+		t.Error("recovery code accepted twice")
+	}
+	if !totpCheck("user", recoveryCodes[1]) {
+		t.Error("second recovery code refused after the first was used")
+	}
+	if totpCheck("user", "not a recovery code") {
+		t.Error("made up recovery code accepted")
+	}
+}
+
+func TestTotpLogin(t *testing.T) {
+	testDbInit(t, "memory")
+	userId, username := testPasswordUser(t, "password123")
+	secret, recoveryCodes := testTotpEnable(t, userId)
+	body := LoginRequestBody{Username: username, Password: "password123"}
+
+	w := testLogin(t, body)
+	if w.Code != http.StatusUnauthorized || strings.TrimSpace(w.Body.String()) != "two-factor code required" {
+		t.Errorf("login without a code = %d %q, want 401 two-factor code required", w.Code, w.Body)
+	}
+	body.Code = "000000"
+	if totpCode(secret, time.Now().Unix()/totpPeriod) == body.Code {
+		body.Code = "111111"
+	}
+	if w := testLogin(t, body); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong code = %d, want 401", w.Code)
+	}
+	for _, code := range []string{totpCode(secret, time.Now().Unix()/totpPeriod), recoveryCodes[0]} {
+		body.Code = code
+		if w := testLogin(t, body); w.Code != http.StatusOK {
+			t.Errorf("login with code %s = %d %q, want 200", code, w.Code, w.Body)
+		}
+	}
+}
+
+// TestTotpConfirmRevokesSessions checks that turning on two-factor
+// authentication ends the user's other sessions but not the one it was
+// turned on from.
+func TestTotpConfirmRevokesSessions(t *testing.T) {
+	testDbInit(t, "memory")
+	c := testConnect(t, testHub())
+	other, ok := sessions.Create(c.userId, "other", "127.0.0.1")
+	if !ok {
+		t.Fatal("sessions.Create failed")
+	}
+	if replies := c.replies(EnrollTotpAction, nil); len(replies) != 1 {
+		t.Fatalf("EnrollTotpAction got %d replies", len(replies))
+	}
+	code := totpCode(testTotpSecret(t, c.userId), time.Now().Unix()/totpPeriod)
+	if replies := c.replies(ConfirmTotpAction, TotpCode{Code: code}); len(replies) != 1 {
+		t.Fatalf("ConfirmTotpAction got %d replies", len(replies))
+	}
+	if _, ok := sessions.Get(other); ok {
+		t.Error("other session survived enabling two-factor authentication")
+	}
+	if _, ok := sessions.Get(c.sessionToken); !ok {
+		t.Error("current session was ended")
+	}
+}
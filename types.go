@@ -13,6 +13,18 @@ const (
 	GetMySettingsAction    uint8 = 8
 	UpdateMySettingsAction uint8 = 9
 	EditChatMessageAction  uint8 = 10
+	LogoutAction           uint8 = 11
+	GetMySessionsAction    uint8 = 12
+	RevokeSessionAction    uint8 = 13
+	ChangePasswordAction   uint8 = 14
+	ResetPasswordAction    uint8 = 15
+	EnrollTotpAction       uint8 = 16
+	ConfirmTotpAction      uint8 = 17
+	DisableTotpAction      uint8 = 18
+	ResetTotpAction        uint8 = 19
+	CreateInviteAction     uint8 = 20
+	GetInvitesAction       uint8 = 21
+	RevokeInviteAction     uint8 = 22
 )
 
 const (
@@ -49,11 +61,13 @@ type User struct {
 }
 
 type ChatMessage struct {
-	Content          string          `json:"content"`
-	Timestamp        int64           `json:"timestamp"`
-	EditForTimestamp int64           `json:"editForTimestamp"`
-	ReplyToUserId    *string         `json:"replyToUserId"`
-	ReplyTo          json.RawMessage `json:"replyTo"`
+	Content          string `json:"content"`
+	Timestamp        int64  `json:"timestamp"`
+	EditForTimestamp int64  `json:"editForTimestamp"`
+	// Set on messages that have had their edits folded in by compaction
+	EditedTimestamp int64           `json:"editedTimestamp,omitempty"`
+	ReplyToUserId   *string         `json:"replyToUserId"`
+	ReplyTo         json.RawMessage `json:"replyTo"`
 }
 
 type NewChatMessage struct {
@@ -82,6 +96,15 @@ type GetChatMessages struct {
 	Start    *int64          `json:"start"`
 	Total    *int            `json:"total"`
 	Messages json.RawMessage `json:"messages"`
+
+	// If Limit is set, messages are fetched by timestamp instead of by
+	// Start/Total byte offsets. Before/After are timestamps of messages to
+	// fetch around, Since is a time to fetch messages from. With none of
+	// them set, the newest messages are fetched.
+	Limit  *int   `json:"limit,omitempty"`
+	Before *int64 `json:"before,omitempty"`
+	After  *int64 `json:"after,omitempty"`
+	Since  *int64 `json:"since,omitempty"`
 }
 
 type GetAllUsers struct {
@@ -102,6 +125,79 @@ type MySettings struct {
 	AudioSettings MyAudioSettings `json:"audioSettings"`
 }
 
+type SessionInfo struct {
+	Id        string `json:"id"`
+	UserAgent string `json:"userAgent"`
+	Ip        string `json:"ip"`
+	Created   int64  `json:"created"`
+	LastUsed  int64  `json:"lastUsed"`
+	// Whether this is the session the request was made with
+	Current bool `json:"current"`
+}
+
+type GetMySessions struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+type RevokeSession struct {
+	Id string `json:"id"`
+}
+
+type ChangePassword struct {
+	// Required if the user already has a password
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	NewPassword     string `json:"newPassword,omitempty"`
+}
+
+// Sent by the server in reply to EnrollTotpAction. The enrollment has to be
+// confirmed with ConfirmTotpAction before it is enabled.
+type EnrollTotp struct {
+	Uri           string   `json:"uri"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// Used by ConfirmTotpAction and DisableTotpAction
+type TotpCode struct {
+	Code string `json:"code"`
+}
+
+// Only developers can reset two-factor authentication
+type ResetTotp struct {
+	UserId string `json:"userId"`
+}
+
+// Only developers can manage invites
+type CreateInvite struct {
+	// How many users can register with the invite, or 0 for no limit
+	MaxUses int `json:"maxUses"`
+	// How long the invite can be used for in milliseconds, or 0 for no limit
+	ExpiresIn int64 `json:"expiresIn"`
+	// Set by the server: when the invite expires, or 0 if it doesn't
+	Expires int64  `json:"expires"`
+	Code    string `json:"code,omitempty"`
+	Id      string `json:"id,omitempty"`
+}
+
+type InviteInfo struct {
+	Id string `json:"id"`
+	Invite
+}
+
+type GetInvites struct {
+	Invites []InviteInfo `json:"invites"`
+}
+
+type RevokeInvite struct {
+	Id string `json:"id"`
+}
+
+// Only developers can reset passwords
+type ResetPassword struct {
+	UserId string `json:"userId"`
+	// The new password, set by the server
+	Password string `json:"password,omitempty"`
+}
+
 type Peer struct {
 	UserId string `json:"userId"`
 	PeerId string `json:"peerId"`